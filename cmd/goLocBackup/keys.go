@@ -0,0 +1,292 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/israbhu/goBackup/internal/pkg/gobackup"
+)
+
+const keyUsage = `commands:
+  init                   create the repository key, encrypting every backup from now on
+  key list               list the key slots
+  key add [label]        add a passphrase
+  key remove <id>        remove the key slot with id
+  key recovery           create a recovery key to print or write down, replacing any earlier one
+  key rotate [-reencrypt] [-drop-slots]
+                         replace the encryption key, -reencrypt also seals every stored value again
+                         so the old key stops working, a new recovery key replaces the old one
+                         -drop-slots confirms dropping the other passphrases, add them again afterwards`
+
+//run the init or key command in args
+func keyCommand(args []string) {
+	if cf.Recipients != "" {
+		log.Fatalln("backups are encrypted to age recipients, their keys are managed with age-keygen")
+	}
+	if cf.KeyFile == "" {
+		log.Fatalln("set the keyfile preference to use encryption")
+	}
+
+	switch {
+	case args[0] == "init":
+		initKey()
+	case args[0] == "key" && len(args) > 1:
+		switch args[1] {
+		case "list":
+			listKeys()
+		case "add":
+			label := "passphrase"
+			if len(args) > 2 {
+				label = args[2]
+			}
+			addKey(label)
+		case "remove":
+			if len(args) != 3 {
+				log.Fatalln("usage: key remove <id>")
+			}
+			removeKey(args[2])
+		case "recovery":
+			recoveryKey()
+		case "rotate":
+			rotateKey(args[2:])
+		default:
+			log.Fatalln(keyUsage)
+		}
+	default:
+		log.Fatalln(keyUsage)
+	}
+}
+
+//load the key file or stop
+func loadKeyFile(targets []gobackup.Target) *gobackup.KeyFile {
+	kf, err := gobackup.LoadKeyFile(&cf, targets)
+	if err == gobackup.ErrNotFound {
+		log.Fatalln("there is no repository key yet, run init first")
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return kf
+}
+
+//save the changed key file locally and on every target or stop
+func saveKeyFile(targets []gobackup.Target, kf *gobackup.KeyFile) {
+	if err := gobackup.SaveKeyFile(&cf, targets, kf); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+//create the repository key with a passphrase and a recovery key
+func initKey() {
+	targets := newTargets()
+	_, err := gobackup.LoadKeyFile(&cf, targets)
+	if err == nil {
+		log.Fatalln("the repository already has a key, see key list")
+	}
+	if err != gobackup.ErrNotFound {
+		log.Fatalln(err)
+	}
+
+	passphrase, err := gobackup.Passphrase(&cf, true)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	key, kf, err := gobackup.InitRepoKey(&cf, targets, passphrase)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("Created the repository key in " + cf.KeyFile)
+	addRecovery(targets, kf, key)
+}
+
+//print the key slots
+func listKeys() {
+	kf := loadKeyFile(newTargets())
+	for _, s := range kf.Slots {
+		kind := "passphrase"
+		if s.Recovery {
+			kind = "recovery key"
+		}
+		fmt.Printf("%v  %-20v %-12v created %v\n", s.ID, s.Label, kind, s.Created.Format("2006-01-02 15:04"))
+	}
+}
+
+//add a passphrase slot labelled label
+func addKey(label string) {
+	targets := newTargets()
+	kf := loadKeyFile(targets)
+	key, _, err := gobackup.UnlockKeyFile(&cf, kf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	passphrase, err := gobackup.NewPassphrase()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	slot, err := kf.AddSlot(key, label, passphrase, false)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	saveKeyFile(targets, kf)
+	fmt.Printf("Added key slot %v\n", slot.ID)
+}
+
+//remove the slot with id
+//the passphrase of another slot has to be given, so nobody removes a slot they cannot replace
+func removeKey(id string) {
+	targets := newTargets()
+	kf := loadKeyFile(targets)
+	_, slot, err := gobackup.UnlockKeyFile(&cf, kf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if slot.ID == id {
+		log.Fatalln("key slot " + id + " is the one that was unlocked, give the passphrase of another slot to remove it")
+	}
+	if err := kf.RemoveSlot(id); err != nil {
+		log.Fatalln(err)
+	}
+	saveKeyFile(targets, kf)
+	fmt.Printf("Removed key slot %v\n", id)
+	fmt.Println("Run key rotate -reencrypt if whoever held it may have kept a copy of the key")
+}
+
+//replace the recovery key
+func recoveryKey() {
+	targets := newTargets()
+	kf := loadKeyFile(targets)
+	key, _, err := gobackup.UnlockKeyFile(&cf, kf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	addRecovery(targets, kf, key)
+}
+
+//add a new recovery slot to kf in place of any earlier one and print its key
+func addRecovery(targets []gobackup.Target, kf *gobackup.KeyFile, key *gobackup.RepoKey) {
+	//removing a slot shifts the ones after it, so they are picked out first
+	var old []string
+	for _, s := range kf.Slots {
+		if s.Recovery {
+			old = append(old, s.ID)
+		}
+	}
+	for _, id := range old {
+		if err := kf.RemoveSlot(id); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	recovery, err := gobackup.NewRecoveryKey()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := kf.AddSlot(key, "recovery", recovery, true); err != nil {
+		log.Fatalln(err)
+	}
+	saveKeyFile(targets, kf)
+	printRecovery(recovery)
+}
+
+//print a new recovery key
+func printRecovery(recovery string) {
+	fmt.Println("Recovery key, keep it somewhere safe and offline:")
+	fmt.Println()
+	fmt.Println("    " + recovery)
+	fmt.Println()
+	fmt.Println("It opens the backups in place of a passphrase, e.g. " + gobackup.PassphraseEnv + "=<recovery key>")
+}
+
+//replace the encryption key
+//only the slot that was opened can be wrapped again, a new recovery key replaces the old one
+//the other passphrases are only dropped with -drop-slots, they have to be added again
+func rotateKey(args []string) {
+	flags := flag.NewFlagSet("key rotate", flag.ExitOnError)
+	reencrypt := flags.Bool("reencrypt", false, "seal every stored value again with the new key")
+	dropSlots := flags.Bool("drop-slots", false, "drop the passphrases other than the one given")
+	flags.Parse(args)
+
+	targets := newTargets()
+	kf := loadKeyFile(targets)
+	passphrase, err := gobackup.Passphrase(&cf, false)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	key, slot, err := kf.Unwrap(passphrase)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	//a passphrase slot can only be wrapped again with its passphrase, so the others are dropped once confirmed
+	var dropped []gobackup.KeySlot
+	recovery := ""
+	for _, s := range kf.Slots {
+		switch {
+		case s.ID == slot.ID:
+		case s.Recovery:
+			if recovery, err = gobackup.NewRecoveryKey(); err != nil {
+				log.Fatalln(err)
+			}
+		default:
+			dropped = append(dropped, s)
+		}
+	}
+	if len(dropped) > 0 && !*dropSlots {
+		for _, s := range dropped {
+			fmt.Printf("Key slot %v (%v) cannot be kept, it was not opened\n", s.ID, s.Label)
+		}
+		log.Fatalln("run key rotate -drop-slots to rotate without them and add them again with key add afterwards")
+	}
+
+	next, err := gobackup.RotateKey(key)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	wrapRotated(targets, next, slot, passphrase, recovery)
+
+	fmt.Println("Rotated the repository key, the old key is kept to read existing backups")
+	for _, s := range dropped {
+		fmt.Printf("Dropped key slot %v (%v), add it again with key add\n", s.ID, s.Label)
+	}
+	if recovery != "" {
+		printRecovery(recovery)
+	}
+
+	if *reencrypt {
+		failed := false
+		for _, t := range targets {
+			t.SetKey(next)
+			n, err := t.Reencrypt()
+			fmt.Printf("%v: %v values sealed again\n", t.Name, n)
+			if err != nil {
+				fmt.Printf("%v: %v\n", t.Name, err)
+				failed = true
+			}
+		}
+		if failed {
+			fmt.Println("Not every value was sealed again, the old key is kept, run key rotate -reencrypt again")
+			os.Exit(1)
+		}
+		next.Old = nil
+		wrapRotated(targets, next, slot, passphrase, recovery)
+		fmt.Println("Every value is sealed with the new key, the old key was dropped")
+	}
+}
+
+//build a key file for key holding slot, wrapped again with passphrase, and save it
+//recovery adds a recovery slot opened by it unless it is blank
+func wrapRotated(targets []gobackup.Target, key *gobackup.RepoKey, slot *gobackup.KeySlot, passphrase string, recovery string) {
+	kf := &gobackup.KeyFile{Version: gobackup.KeyFileVersion}
+	if _, err := kf.AddSlot(key, slot.Label, passphrase, slot.Recovery); err != nil {
+		log.Fatalln(err)
+	}
+	if recovery != "" {
+		if _, err := kf.AddSlot(key, "recovery", recovery, true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	saveKeyFile(targets, kf)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -18,15 +17,149 @@ import (
 
 //***************global variables*************
 var cf gobackup.Account //account credentials and preferences
-var dat gobackup.Data1  //local datastore tracking uploads and Metadata
 var verbose bool        //flag for extra info output to console
 
-//backs up the list of files
-//uploading the data should be the most time consuming portion of the program, so it will pushed into a go routine
-func backup(list []string) {
-	for _, list := range list {
-		gobackup.UploadKV(&cf, &dat, list)
+//how many files are hashed and uploaded at once when neither -jobs nor the jobs preference is set
+const defaultJobs = 4
+
+//record the metadata of what each target holds, encrypted along with the data, and report how each target did
+//list holds the files uploaded this run with the targets now holding them
+func saveMetadata(targets []gobackup.Target, list []gobackup.Metadata) {
+	failed := map[string]int{}
+	stored := map[string]int{}
+
+	//record the metadata of what each target holds, encrypted along with the data
+	for _, t := range targets {
+		var held []gobackup.Metadata
+		for _, meta := range list {
+			if gobackup.HasTarget(meta, t.Name) {
+				held = append(held, meta)
+			}
+		}
+		if err := t.SaveMetadata(held); err != nil {
+			fmt.Println("METADATA UPLOAD FAILED! " + t.Name + ": " + err.Error())
+		}
+	}
+
+	//report how each target did
+	for _, meta := range list {
+		for _, t := range targets {
+			if gobackup.HasTarget(meta, t.Name) {
+				stored[t.Name]++
+			} else {
+				failed[t.Name]++
+			}
+		}
+	}
+	for _, t := range targets {
+		fmt.Printf("%v: %v stored, %v failed\n", t.Name, stored[t.Name], failed[t.Name])
+	}
+}
+
+//store a snapshot on every target of the files it holds
+//found lists every file of the run, uploaded the files sent this run with their hashes and the targets now holding them
+func snapshot(targets []gobackup.Target, found []gobackup.Metadata, uploaded []gobackup.Metadata, locations []string) {
+	stored := map[gobackup.Stream]gobackup.Metadata{}
+	for _, meta := range uploaded {
+		stored[meta.FileName] = meta
+	}
+	for i, meta := range found {
+		if m, ok := stored[meta.FileName]; ok {
+			found[i] = m
+		}
+	}
+
+	var paths, tags []string
+	for _, l := range locations {
+		if l = strings.TrimSpace(l); l != "" {
+			paths = append(paths, l)
+		}
+	}
+	for _, tag := range strings.Split(cf.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	for _, t := range targets {
+		var held []gobackup.Metadata
+		for _, meta := range found {
+			if gobackup.HasTarget(meta, t.Name) {
+				held = append(held, meta)
+			}
+		}
+		snap, err := t.SaveSnapshot(held, paths, tags)
+		if err != nil {
+			fmt.Println("SNAPSHOT FAILED! " + t.Name + ": " + err.Error())
+			continue
+		}
+		fmt.Printf("%v: snapshot %v of %v files\n", t.Name, snap.ID, len(held))
+		if left := len(found) - len(held); left > 0 {
+			fmt.Printf("%v: %v files are left out of the snapshot, they could not be stored\n", t.Name, left)
+		}
+	}
+}
+
+//create the backends selected in the preferences and set up their encryption and compression
+func openTargets() []gobackup.Target {
+	targets := newTargets()
+
+	key, err := gobackup.OpenCipher(&cf, targets)
+	if err != nil {
+		log.Fatalln("opening the repository key: " + err.Error())
+	}
+	compression, err := gobackup.ParseCompression(cf.Zip)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, t := range targets {
+		t.SetKey(key)
+		t.SetCompression(compression)
+	}
+	return targets
+}
+
+//open the catalog named by the Catalog preference
+//the data.dat of older versions is imported the first time and renamed so it is not read again
+func openCatalog() *gobackup.Catalog {
+	name := catalogName()
+	catalog, err := gobackup.OpenCatalog(name)
+	if err != nil {
+		log.Fatalln("opening the catalog: " + err.Error())
+	}
+
+	if _, err := os.Stat(gobackup.LegacyDataFile); err == nil {
+		count, err := catalog.ImportDataFile(gobackup.LegacyDataFile)
+		if err != nil {
+			log.Fatalln("importing " + gobackup.LegacyDataFile + ": " + err.Error())
+		}
+		if err := os.Rename(gobackup.LegacyDataFile, gobackup.LegacyDataFile+".imported"); err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("Imported %v files from %v into %v\n", count, gobackup.LegacyDataFile, name)
+	}
+	return catalog
+}
+
+//the catalog named by the Catalog preference, the journal is kept next to it
+func catalogName() string {
+	if cf.Catalog == "" {
+		return gobackup.DefaultCatalogFile
+	}
+	return cf.Catalog
+}
+
+//create the backends selected in the preferences without opening the repository key
+//targets that cannot be opened are skipped, the run only stops when none are left
+func newTargets() []gobackup.Target {
+	targets, errs := gobackup.NewTargets(&cf)
+	for _, err := range errs {
+		fmt.Println("SKIPPING TARGET! " + err.Error())
+	}
+	if len(targets) == 0 {
+		log.Fatalln("no backup targets could be opened")
 	}
+	return targets
 }
 
 //read from a toml file
@@ -40,24 +173,13 @@ func readTOML(file string) {
 
 	doc2 := []byte(astring)
 
-	if file == "data.dat" {
-		toml.Unmarshal(doc2, &dat)
-		//verbose flag
-		if verbose {
-			fmt.Println("Reading in the preference file:" + file)
-			fmt.Println(dat)
-		}
+	toml.Unmarshal(doc2, &cf)
 
-	} else {
-		toml.Unmarshal(doc2, &cf)
-
-		//verbose flag
-		if verbose {
-			fmt.Println("Reading in the preference file:" + file)
-			fmt.Println(cf)
-		}
+	//verbose flag
+	if verbose {
+		fmt.Println("Reading in the preference file:" + file)
+		fmt.Println(cf)
 	}
-
 }
 
 //write a toml file
@@ -152,6 +274,18 @@ func getFiles(name string, f []string) []string {
 	return f
 }
 
+//run the command named by the first argument
+func command(args []string) {
+	switch args[0] {
+	case "init", "key":
+		keyCommand(args)
+	case "snapshots", "ls", "restore", "versions", "mount":
+		snapshotCommand(args)
+	default:
+		log.Fatalln(keyUsage + "\n" + snapshotUsage)
+	}
+}
+
 //yes, email, Account, Data, Email, Namespace, Key, Token, Location string
 //backup strategy, zip, encrypt, verbose, sync, list data, alt pref, no pref
 func extractCommandLine() {
@@ -164,9 +298,16 @@ func extractCommandLine() {
 	var locationFlag = flag.String("location", "", "Use only these locations to backup")
 	var backupFlag = flag.String("backup", "", "Backup strategy")
 	var downloadFlag = flag.String("download", "", "Folder/files to download")
-	var zipFlag = flag.String("zip", "", "zip")
+	var zipFlag = flag.String("zip", "", "Compression: none, gzip or zstd, optionally with a level, e.g. zstd:9")
 	var verboseFlag = flag.Bool("v", false, "More information")
 	var altPrefFlag = flag.String("pref", "", "use an alternate preference file")
+	var backendFlag = flag.String("backend", "", "Storage backends to use, comma separated (kv, dir, s3, sftp, webdav)")
+	var identityFlag = flag.String("identity", "", "age identity file for reading backups encrypted to recipients")
+	var exportFlag = flag.String("export", "", "Write every file in the locations to this .zip, .tar.gz or .tgz archive")
+	var importFlag = flag.String("import", "", "Extract a .zip, .tar.gz or .tgz archive made by -export")
+	var destFlag = flag.String("dest", ".", "Where -import extracts to")
+	var jobsFlag = flag.Int("jobs", 0, "How many files to hash and upload at once")
+	var tagFlag = flag.String("tag", "", "Tags for this run's snapshot, comma separated")
 
 	flag.Parse()
 
@@ -205,58 +346,52 @@ func extractCommandLine() {
 	if *zipFlag != "" {
 		cf.Zip = *zipFlag
 	}
+	if *backendFlag != "" {
+		cf.Backend = *backendFlag
+	}
+	if *jobsFlag > 0 {
+		cf.Jobs = *jobsFlag
+	}
+	if *tagFlag != "" {
+		cf.Tags = *tagFlag
+	}
+	if *identityFlag != "" {
+		cf.Identity = *identityFlag
+	}
 	if *verboseFlag {
 		verbose = true
 		fmt.Println("Extracting flags from commandline:")
 	}
 	if *downloadFlag != "" {
 		cf.Location = *downloadFlag //hash
-		gobackup.DownloadKV(&cf, *downloadFlag, "download.file")
+		err := gobackup.DownloadAny(openTargets(), *downloadFlag, "download.file")
+		if err != nil {
+			log.Fatalln(err)
+		}
 		fmt.Println("Downloaded a file!")
 		os.Exit(0)
 	}
-
-}
-
-//search the data file for hash, line by line
-//hash is the hash from a file, fileName is a file
-//in the future, may introduce a binary search or a simple index for a pre-sorted data file
-func searchData(hash string, fileName string) bool {
-
-	file, err := os.Open("data.dat")
-	if err != nil {
-		log.Fatalf("searchData failed opening file:data.dat")
-	}
-	scan := bufio.NewScanner(file)
-	scan.Split(bufio.ScanLines)
-	for scan.Scan() {
-		a := scan.Text()           //get lines of data.dat
-		b := strings.Split(a, ":") //split out the data
-		if len(b[0]) != 32 {
-			b[0] = b[0][:32] //get the base hash
-		}
-
-		if b[0] == hash && fileName == b[1] {
-			return true
+	if *exportFlag != "" {
+		count, err := gobackup.ExportArchive(*exportFlag, strings.Split(cf.Location, ","))
+		if err != nil {
+			log.Fatalln(err)
 		}
+		fmt.Printf("Exported %v entries to %v\n", count, *exportFlag)
+		os.Exit(0)
 	}
-	return false
-}
-
-//create a toml file from a struct
-func dataFile() {
-	doc, _ := toml.Marshal(&dat)
-
-	fmt.Println(string(doc))
-	fmt.Println(dat)
-	err := ioutil.WriteFile("data.dat", doc, 0644)
-	if err != nil {
-		log.Fatalln(err)
+	if *importFlag != "" {
+		count, err := gobackup.ImportArchive(*importFlag, *destFlag)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("Imported %v entries into %v\n", count, *destFlag)
+		os.Exit(0)
 	}
-	_, err = os.Lstat("data.dat")
-	if err != nil {
-		log.Fatalln(err)
+	if flag.NArg() > 0 {
+		command(flag.Args())
+		os.Exit(0)
 	}
+
 }
 
 //******* This struct contains the data needed to access the cloudflare infrastructure. It is stored on drive in the file preferences.toml *****
@@ -270,7 +405,8 @@ type Account struct {
 	Data,
 	Location,
 	Zip,
-	Backup string
+	Backup,
+	Backend string
 }
 
 // extract toml data for account and behaviour information
@@ -278,13 +414,10 @@ type Account struct {
 // backup the data
 func main() {
 
-	fmt.Println(gobackup.GetMetadata(gobackup.Metadata{}))
 	readTOML("preferences.toml")
 	fmt.Println(cf)
 	fmt.Println("****************************")
 
-	fmt.Println("zipping a file")
-	gobackup.ZipFile("zipsuite.txt", "zipsuite.zip")
 	//get the command arguments
 	//command line can overwrite the data from the preferences file
 	extractCommandLine()
@@ -300,38 +433,50 @@ func main() {
 
 	sort.Strings(fileList)
 
-	//fill in the Metadata
-	for _, f := range fileList {
-		hash := gobackup.Md5file(f)
+	targets := openTargets()
+	catalog := openCatalog()
 
-		//if not found
-		if !searchData(hash, f) {
-			meta := gobackup.CreateMeta(f)
-			fmt.Println("NOT FOUND AND INCLUDING! " + hash + "-" + gobackup.GetMetadata(meta))
+	//fill in the Metadata
+	jobs := cf.Jobs
+	if jobs <= 0 {
+		jobs = defaultJobs
+	}
 
-			//update the data struct
-			dat.TheMetadata = append(dat.TheMetadata, meta)
+	//what reaches the targets is journaled as it happens, so an interrupted run can be resumed
+	journal, err := gobackup.OpenJournal(gobackup.JournalFile(catalogName()))
+	if err != nil {
+		log.Fatalln("opening the journal: " + err.Error())
+	}
 
-			sort.Sort(gobackup.ByHash(dat.TheMetadata))
+	//find the files a target is missing and upload them, each stage on its own workers
+	//a file is read once, it is hashed as it is uploaded
+	found, list, err := gobackup.Upload(fileList, targets, catalog, journal, jobs)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(list) == 0 {
+		fmt.Println("All files are up to date!")
+	} else {
+		saveMetadata(targets, list)
+		sort.Sort(gobackup.ByHash(list))
 
-			dat.DataSize += meta.Size
-			dat.Count += 1
-		} else {
-			fmt.Println("FOUND AND EXCLUDING! " + hash)
+		var size int64
+		for _, meta := range list {
+			size += meta.Size
 		}
-	} //for
+		fmt.Printf("Data Size: %v, Data Count: %v\n", size, len(list))
 
-	if len(dat.TheMetadata) == 0 {
-		fmt.Println("All files are up to date! Exiting!")
-		os.Exit(0)
+		//record the run in the catalog in one transaction, after which the journal is no longer needed
+		if err := catalog.Add(list); err != nil {
+			log.Fatalln("updating the catalog: " + err.Error())
+		}
 	}
+	if err := journal.Remove(); err != nil {
+		fmt.Println(err)
+	}
+	catalog.Close()
 
-	fmt.Printf("Data Size: %v, Data Count: %v", dat.DataSize, dat.Count)
-	//split the work and backup
-	backup(fileList)
-	fmt.Println(gobackup.DownloadKV(&cf, dat.TheMetadata[0].Hash, "test.txt"))
-
-	//update the local data file
-	gobackup.DataFile2("data.dat", &dat)
+	//record what the locations held at the end of the run, unchanged files included
+	snapshot(targets, found, list, backupLocations)
 
 } //main
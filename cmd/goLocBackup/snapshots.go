@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	pathpkg "path"
+	"strings"
+	"syscall"
+
+	"github.com/israbhu/goBackup/internal/pkg/gobackup"
+)
+
+const snapshotUsage = `  snapshots              list the snapshots on each target
+  ls <snapshot> [path]   list a directory, or show a file, as it was in a snapshot
+                         snapshot is latest, an id or a date or time, e.g. 2026-10-13 for the end of that day
+  restore <snapshot> [path] -target dir [-include glob] [-exclude glob]
+                         rebuild the snapshot, or only path in it, under dir at the original paths
+                         -include and -exclude can be given several times, e.g. -include '*.xlsx'
+  versions <path>        list the versions of a file in the snapshots, restore one with its snapshot id
+  mount <dir> [-cache dir] [-cache-size MB]
+                         browse the snapshots read only under dir/snapshots/<id>, until interrupted
+                         files are downloaded when opened and kept in the cache, up to 1024MB by default, 0 for no limit
+                         without -cache a new directory in the user's cache directory is used and removed on unmount`
+
+//run the snapshot command in args
+func snapshotCommand(args []string) {
+	switch {
+	case args[0] == "snapshots" && len(args) == 1:
+		listSnapshots()
+	case args[0] == "ls" && (len(args) == 2 || len(args) == 3):
+		path := "/"
+		if len(args) == 3 {
+			path = args[2]
+		}
+		listSnapshot(args[1], path)
+	case args[0] == "restore" && len(args) > 1:
+		restoreSnapshot(args[1], args[2:])
+	case args[0] == "versions" && len(args) == 2:
+		listVersions(args[1])
+	case args[0] == "mount" && len(args) > 1:
+		mountSnapshots(args[1], args[2:])
+	default:
+		log.Fatalln(snapshotUsage)
+	}
+}
+
+//print the snapshots on every target
+func listSnapshots() {
+	for _, t := range openTargets() {
+		snaps, err := t.Snapshots()
+		if err != nil {
+			fmt.Printf("%v: %v\n", t.Name, err)
+			continue
+		}
+		fmt.Printf("%v: %v snapshots\n", t.Name, len(snaps))
+		for _, s := range snaps {
+			fmt.Printf("%v  %v  %-16v %-20v %v\n", s.ID, s.Time.Local().Format("2006-01-02 15:04:05"), s.Host, strings.Join(s.Tags, ","), strings.Join(s.Paths, ","))
+		}
+	}
+}
+
+//find the snapshot picked by spec on the first target holding a match, or stop
+func findSnapshot(spec string) (gobackup.Target, *gobackup.Snapshot) {
+	for _, t := range openTargets() {
+		snaps, err := t.Snapshots()
+		if err != nil {
+			fmt.Printf("%v: %v\n", t.Name, err)
+			continue
+		}
+		snap, err := gobackup.FindSnapshot(snaps, spec)
+		if err != nil {
+			fmt.Printf("%v: %v\n", t.Name, err)
+			continue
+		}
+		fmt.Printf("snapshot %v of %v taken %v\n", snap.ID, snap.Host, snap.Time.Local().Format("2006-01-02 15:04:05"))
+		return t, snap
+	}
+	log.Fatalln("no target holds a matching snapshot")
+	return gobackup.Target{}, nil
+}
+
+//print the entry at path in the snapshot picked by spec, every entry when it is a directory
+func listSnapshot(spec string, path string) {
+	t, snap := findSnapshot(spec)
+	node, err := t.FindNode(snap, path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if node.Type != gobackup.NodeDir {
+		printNode(node)
+		return
+	}
+	tree, err := t.LoadTree(node.Tree)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, n := range tree.Nodes {
+		printNode(n)
+	}
+}
+
+//restore the snapshot picked by spec, args are an optional path and the flags
+func restoreSnapshot(spec string, args []string) {
+	path := "/"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		path, args = args[0], args[1:]
+	}
+	var opts gobackup.RestoreOptions
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	target := flags.String("target", "", "the directory to restore into")
+	flags.Var((*globs)(&opts.Include), "include", "only restore files matching this glob")
+	flags.Var((*globs)(&opts.Exclude), "exclude", "leave out files matching this glob")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		log.Fatalln(snapshotUsage)
+	}
+	if *target == "" {
+		log.Fatalln("give the directory to restore into with -target")
+	}
+
+	opts.Jobs = cf.Jobs
+	if opts.Jobs <= 0 {
+		opts.Jobs = defaultJobs
+	}
+	t, snap := findSnapshot(spec)
+	stats, err := t.RestoreSnapshot(snap, path, *target, opts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, err := range stats.Errors {
+		fmt.Println("RESTORE FAILED! " + err.Error())
+	}
+	fmt.Printf("Restored %v files and %v directories into %v, %v files were already in place, %v failed\n", stats.Files, stats.Dirs, *target, stats.Unchanged, len(stats.Errors))
+	if len(stats.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+//print a tree entry like ls -l
+func printNode(n gobackup.Node) {
+	name := n.Name
+	mode := n.Mode
+	if n.Type == gobackup.NodeDir {
+		name += "/"
+		if mode != "" {
+			mode = "d" + mode[1:]
+		}
+	}
+	fmt.Printf("%-10v %12v  %v  %v\n", mode, n.Size, n.ModTime.Local().Format("2006-01-02 15:04"), name)
+}
+
+//globs given with a repeated flag
+type globs []string
+
+func (g *globs) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globs) Set(pattern string) error {
+	if _, err := pathpkg.Match(pattern, ""); err != nil {
+		return fmt.Errorf("%v: %v", pattern, err)
+	}
+	*g = append(*g, pattern)
+	return nil
+}
+
+//print the versions of the file at path, from the first target holding snapshots
+func listVersions(path string) {
+	for _, t := range openTargets() {
+		snaps, err := t.Snapshots()
+		if err != nil {
+			fmt.Printf("%v: %v\n", t.Name, err)
+			continue
+		}
+		if len(snaps) == 0 {
+			continue
+		}
+		versions, err := t.FileVersions(snaps, path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, v := range versions {
+			seen := v.First.Time.Local().Format("2006-01-02 15:04")
+			if v.Count > 1 {
+				seen += " to " + v.Last.Time.Local().Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%v  %12v  modified %v  %v  in %v snapshots, %v\n", v.Last.ID, v.Node.Size, v.Node.ModTime.Local().Format("2006-01-02 15:04"), v.Node.Hash, v.Count, seen)
+		}
+		return
+	}
+	log.Fatalln("no target holds any snapshots")
+}
+
+//mount the snapshots of the first target holding any at dir, until interrupted, args are the flags
+func mountSnapshots(dir string, args []string) {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	cache := flags.String("cache", "", "the directory keeping downloaded files")
+	cacheSize := flags.Int64("cache-size", gobackup.DefaultCacheSize>>20, "the most megabytes of downloaded files kept, 0 for no limit")
+	flags.Parse(args)
+	if flags.NArg() > 0 || *cacheSize < 0 {
+		log.Fatalln(snapshotUsage)
+	}
+	if *cache != "" {
+		if err := mountFirst(dir, *cache, *cacheSize<<20); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	//the decrypted files should not outlive the mount unless a cache was asked for
+	base, err := os.UserCacheDir()
+	if err == nil {
+		err = os.MkdirAll(base, 0700)
+	}
+	if err != nil {
+		log.Fatalln("give the directory keeping downloaded files with -cache:", err)
+	}
+	temp, err := os.MkdirTemp(base, "goLocBackup-mount-")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = mountFirst(dir, temp, *cacheSize<<20)
+	if rerr := os.RemoveAll(temp); rerr != nil {
+		fmt.Println("REMOVING THE CACHE FAILED! " + rerr.Error())
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+//mount the snapshots of the first target holding any at dir, keeping downloaded files in cache, and wait until interrupted
+func mountFirst(dir string, cache string, cacheSize int64) error {
+	for _, t := range openTargets() {
+		snaps, err := t.Snapshots()
+		if err != nil {
+			fmt.Printf("%v: %v\n", t.Name, err)
+			continue
+		}
+		if len(snaps) == 0 {
+			continue
+		}
+		m, err := gobackup.MountSnapshots(t.Repo, dir, cache, cacheSize)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%v snapshots of %v mounted at %v, interrupt to unmount\n", len(snaps), t.Name, dir)
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-stop
+			if err := m.Unmount(); err != nil {
+				fmt.Println("UNMOUNT FAILED! " + err.Error())
+			}
+		}()
+		m.Wait()
+		return nil
+	}
+	return errors.New("no target holds any snapshots")
+}
@@ -1,5 +1,20 @@
 module github.com/israbhu/goBackup
 
-go 1.15
+go 1.26.0
 
-require github.com/pelletier/go-toml v1.9.0
+require (
+	filippo.io/age v1.2.1
+	github.com/hanwen/go-fuse/v2 v2.11.0
+	github.com/klauspost/compress v1.18.0
+	github.com/pelletier/go-toml v1.9.0
+	github.com/pkg/sftp v1.13.11
+	go.etcd.io/bbolt v1.5.0
+	golang.org/x/crypto v0.57.0
+	golang.org/x/net v0.58.0
+	golang.org/x/term v0.46.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+)
@@ -0,0 +1,215 @@
+package gobackup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+//returned when reading a value encrypted to age recipients without an identity
+var ErrNoIdentity = errors.New("gobackup: an age identity is needed to read the backups, set the identity preference")
+
+//where every target keeps the key hiding stored names, encrypted to the recipients
+const RemoteNameKey = "keys/names"
+
+//the local copy of the name key used when the NameKey preference is blank
+const DefaultNameKeyFile = "names.key"
+
+//AgeKey encrypts every value to age X25519 recipients
+//a host holding only the recipients can store new backups but cannot read old ones, restoring needs the identity
+//stored names are hidden with a random key, see OpenAgeKey
+type AgeKey struct {
+	recipients []age.Recipient
+	identities []age.Identity
+	mac        []byte
+}
+
+//parse the comma separated age public keys in recipients and the identity file called identityFile
+//identityFile may be blank on hosts that only store backups
+//mac is the key hiding stored names, see OpenAgeKey
+func NewAgeKey(recipients string, identityFile string, mac []byte) (*AgeKey, error) {
+	list := strings.Split(recipients, ",")
+	for i := range list {
+		list[i] = strings.TrimSpace(list[i])
+	}
+	rs, err := age.ParseRecipients(strings.NewReader(strings.Join(list, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("recipients: %v", err)
+	}
+	k := &AgeKey{recipients: rs, mac: mac}
+
+	if identityFile != "" {
+		file, err := os.Open(expandHome(identityFile))
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if k.identities, err = age.ParseIdentities(file); err != nil {
+			return nil, fmt.Errorf("%v: %v", identityFile, err)
+		}
+	}
+	return k, nil
+}
+
+//encrypt plaintext to the recipients
+//age has no associated data, so name is written inside the encrypted value and checked by Open
+func (k *AgeKey) Seal(name string, plaintext []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, k.recipients...)
+	if err != nil {
+		return nil, err
+	}
+
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(name)))
+	w.Write(size[:])
+	w.Write([]byte(name))
+	w.Write(plaintext)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+//decrypt a value made by Seal with the identity
+//returns ErrNoIdentity without one and ErrTampered if the value does not authenticate or was made for another name
+func (k *AgeKey) Open(name string, sealed []byte) ([]byte, error) {
+	if len(k.identities) == 0 {
+		return nil, ErrNoIdentity
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(sealed), k.identities...)
+	if _, ok := err.(*age.NoIdentityMatchError); ok {
+		return nil, errors.New("the value was not encrypted to this identity")
+	}
+	if err != nil {
+		return nil, ErrTampered
+	}
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, ErrTampered
+	}
+
+	if len(plain) < 2 {
+		return nil, ErrTampered
+	}
+	n := int(binary.BigEndian.Uint16(plain))
+	if len(plain) < 2+n || string(plain[2:2+n]) != name {
+		return nil, ErrTampered
+	}
+	return plain[2+n:], nil
+}
+
+//can values be decrypted, only when there is an identity
+func (k *AgeKey) canOpen() bool {
+	return len(k.identities) > 0
+}
+
+//the key a value named by the content hash name is stored under, see RepoKey.HideName
+func (k *AgeKey) HideName(name string) string {
+	mac := hmac.New(sha256.New, k.mac)
+	mac.Write([]byte(name))
+	return hashToString(mac.Sum(nil)[:len(name)/2])
+}
+
+//open the age encryption selected in the preferences, along with the key hiding stored names
+//a host that cannot decrypt still has to name the values it stores, so the name key is kept locally in the NameKey file
+//a host without it fetches the copy on the targets, which is encrypted to the recipients and needs the identity
+//the first run makes a random name key and stores it in both places
+func OpenAgeKey(cf *Account, targets []Target) (*AgeKey, error) {
+	k, err := NewAgeKey(cf.Recipients, cf.Identity, nil)
+	if err != nil {
+		return nil, err
+	}
+	name := cf.NameKey
+	if name == "" {
+		name = DefaultNameKeyFile
+	}
+
+	data, err := ioutil.ReadFile(expandHome(name))
+	if err == nil {
+		if k.mac, err = hex.DecodeString(strings.TrimSpace(string(data))); err != nil || len(k.mac) != 32 {
+			return nil, fmt.Errorf("%v is not a name key", name)
+		}
+		return k, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if k.mac, err = k.fetchNameKey(targets); err == ErrNoIdentity {
+		return nil, fmt.Errorf("the backups hide their names with a key this host lacks, copy %v from a host that has it or set the identity preference", name)
+	}
+	if err == ErrNotFound {
+		k.mac, err = newNameKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(expandHome(name), []byte(hex.EncodeToString(k.mac)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	sealed, err := k.Seal(RemoteNameKey, k.mac)
+	if err != nil {
+		return nil, err
+	}
+	return k, storeNameKey(targets, sealed)
+}
+
+//get the name key from the first target that has a copy, returns ErrNotFound when none has
+func (k *AgeKey) fetchNameKey(targets []Target) ([]byte, error) {
+	for _, t := range targets {
+		var buf bytes.Buffer
+		err := t.Get(RemoteNameKey, &buf)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", t.Name, err)
+		}
+		mac, err := k.Open(RemoteNameKey, buf.Bytes())
+		if err == nil && len(mac) != 32 {
+			err = ErrTampered
+		}
+		if err != nil && err != ErrNoIdentity {
+			return nil, fmt.Errorf("%v: %v: %v", t.Name, RemoteNameKey, err)
+		}
+		return mac, err
+	}
+	return nil, ErrNotFound
+}
+
+//make the random name key of a repository that has none yet
+func newNameKey() ([]byte, error) {
+	mac := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, mac); err != nil {
+		return nil, err
+	}
+	return mac, nil
+}
+
+//copy the sealed name key to the targets that do not hold one yet
+func storeNameKey(targets []Target, sealed []byte) error {
+	for _, t := range targets {
+		_, err := t.Stat(RemoteNameKey)
+		if err == ErrNotFound {
+			err = t.Put(RemoteNameKey, bytes.NewReader(sealed))
+		}
+		if err != nil {
+			return fmt.Errorf("%v: storing the name key: %v", t.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package gobackup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+//the name key is random, kept locally and fetched from the targets by a host with the identity
+func TestAgeNameKey(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	identity := filepath.Join(dir, "age.key")
+	if err := os.WriteFile(identity, []byte(id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	targets := []Target{{Name: "mem", Repo: NewRepo(newMemBackend(), 0)}}
+
+	//a host storing backups, without the identity
+	store := &Account{Recipients: id.Recipient().String(), NameKey: filepath.Join(dir, "store.key")}
+	k, err := OpenAgeKey(store, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//another repository of the same recipients gets a name key of its own
+	second, err := OpenAgeKey(&Account{Recipients: store.Recipients, NameKey: filepath.Join(dir, "second.key")},
+		[]Target{{Name: "mem", Repo: NewRepo(newMemBackend(), 0)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(k.mac, second.mac) {
+		t.Fatal("two repositories of the same recipients share a name key")
+	}
+	sealed, err := k.Seal("name", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Open("name", sealed); err != ErrNoIdentity {
+		t.Fatalf("a host without the identity opened a value: %v", err)
+	}
+	if again, err := OpenAgeKey(store, targets); err != nil || again.HideName("abcd") != k.HideName("abcd") {
+		t.Fatalf("the local name key was not kept: %v", err)
+	}
+
+	//a new host without the identity cannot name anything, one with it fetches the key
+	other := &Account{Recipients: store.Recipients, NameKey: filepath.Join(dir, "other.key")}
+	if _, err := OpenAgeKey(other, targets); err == nil {
+		t.Fatal("a host without the identity or name key opened the repository")
+	}
+	other.Identity = identity
+	restore, err := OpenAgeKey(other, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restore.HideName("abcd") != k.HideName("abcd") {
+		t.Fatal("the fetched name key differs")
+	}
+	if got, err := restore.Open("name", sealed); err != nil || string(got) != "value" {
+		t.Fatalf("opening with the identity gave %q, %v", got, err)
+	}
+}
@@ -0,0 +1,141 @@
+package gobackup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//returned by a Backend when the requested key is not stored
+var ErrNotFound = errors.New("gobackup: key not found")
+
+//describes a single stored object
+//Size is -1 when the backend cannot report it cheaply
+type ObjectInfo struct {
+	Key  string
+	Size int64
+}
+
+//Backend is a place that stores backup objects by key
+//the keys are the ones produced by the backup pipeline, currently the hash from Md5file
+type Backend interface {
+	//store everything read from r under key, replacing any existing value
+	Put(key string, r io.Reader) error
+	//write the value stored under key into w
+	Get(key string, w io.Writer) error
+	//list every stored key that starts with prefix, "" lists everything
+	List(prefix string) ([]string, error)
+	//remove key, deleting a missing key is not an error
+	Delete(key string) error
+	//get information about key, returns ErrNotFound if it is not stored
+	Stat(key string) (ObjectInfo, error)
+}
+
+//a destination for the backups
+//Name is the backend name from the preferences and is what the catalog records in Metadata.Targets
+type Target struct {
+	Name string
+	*Repo
+}
+
+//create every backend listed in the Backend preference, e.g. backend="kv,dir" replicates each upload to both
+//an empty preference means Workers KV so older preference files keep working
+//a target that cannot be opened is returned in errs and left out, so one unreachable server does not stop the others
+func NewTargets(cf *Account) (targets []Target, errs []error) {
+	seen := map[string]bool{}
+
+	for _, name := range strings.Split(cf.Backend, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "", "workerskv":
+			name = "kv"
+		case "r2":
+			name = "s3"
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		b, err := NewBackend(name, cf)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v backend: %v", name, err))
+			continue
+		}
+		targets = append(targets, Target{Name: name, Repo: NewRepo(b, cf.PackSize)})
+	}
+	return targets, errs
+}
+
+//create a single backend by name using the matching section of cf
+func NewBackend(name string, cf *Account) (Backend, error) {
+	switch name {
+	case "kv":
+		return NewKV(cf), nil
+	case "dir":
+		return NewDir(cf.Dir.Path)
+	case "s3":
+		return NewS3(cf)
+	case "sftp":
+		return NewSFTP(cf)
+	case "webdav":
+		return NewWebDAV(cf)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+}
+
+//is name one of the targets holding the object
+func HasTarget(meta Metadata, name string) bool {
+	for _, t := range meta.Targets {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+//upload the object described by meta to every target that does not hold it yet
+//a failing target is reported and skipped so it cannot stop the others, the next run retries it
+//meta.Targets is updated with each target that succeeded, meta.Chunks and meta.Codec with how the file was stored
+//the file is read once for all the targets and hashed as it is read, see SaveFile, a blank meta.Hash is filled in
+func Replicate(targets []Target, meta *Metadata) []error {
+	var pending []Target
+	var repos []*Repo
+	for _, t := range targets {
+		if !HasTarget(*meta, t.Name) {
+			pending = append(pending, t)
+			repos = append(repos, t.Repo)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var errs []error
+	hash, chunks, codec, saveErrs := SaveFile(repos, meta.Hash, string(meta.FileName))
+	for i, t := range pending {
+		if saveErrs[i] != nil {
+			errs = append(errs, fmt.Errorf("%v: %v: %v", t.Name, meta.FileName, saveErrs[i]))
+			continue
+		}
+		meta.Hash = hash
+		meta.Chunks = chunks
+		meta.Codec = codec
+		meta.Targets = append(meta.Targets, t.Name)
+	}
+	return errs
+}
+
+//download key from the first target that holds it
+func DownloadAny(targets []Target, key string, filepath string) error {
+	err := ErrNotFound
+	for _, t := range targets {
+		if err = t.RestoreFile(key, filepath); err == nil {
+			return nil
+		}
+		fmt.Printf("%v: %v\n", t.Name, err)
+	}
+	return err
+}
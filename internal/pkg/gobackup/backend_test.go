@@ -0,0 +1,220 @@
+package gobackup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//memBackend is a Backend keeping every value in memory
+type memBackend struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{values: map[string][]byte{}}
+}
+
+func (m *memBackend) Put(key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = data
+	return nil
+}
+
+func (m *memBackend) Get(key string, w io.Writer) error {
+	m.mu.Lock()
+	data, ok := m.values[key]
+	m.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (m *memBackend) List(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for k := range m.values {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *memBackend) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+func (m *memBackend) Stat(key string) (ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.values[key]
+	if !ok {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return ObjectInfo{Key: key, Size: int64(len(data))}, nil
+}
+
+//check that b keeps the promises of the Backend interface
+//values are binary and keys are nested like the ones the repo stores
+func testBackend(t *testing.T, b Backend) {
+	t.Helper()
+	large := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(large)
+	values := map[string][]byte{
+		"chunks/aa": []byte("first"),
+		"chunks/ab": large,
+		"packs/ac":  {0, 0xff, '\n', 0x80},
+	}
+	for key, value := range values {
+		if err := b.Put(key, bytes.NewReader(value)); err != nil {
+			t.Fatalf("put %v: %v", key, err)
+		}
+	}
+	//a put replaces the value
+	values["chunks/aa"] = []byte("second")
+	if err := b.Put("chunks/aa", bytes.NewReader(values["chunks/aa"])); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range values {
+		var buf bytes.Buffer
+		if err := b.Get(key, &buf); err != nil {
+			t.Fatalf("get %v: %v", key, err)
+		}
+		if !bytes.Equal(buf.Bytes(), value) {
+			t.Fatalf("get %v returned %v bytes that differ from the %v put", key, buf.Len(), len(value))
+		}
+		info, err := b.Stat(key)
+		if err != nil {
+			t.Fatalf("stat %v: %v", key, err)
+		}
+		if info.Key != key || (info.Size != -1 && info.Size != int64(len(value))) {
+			t.Fatalf("stat %v returned %+v, want %v bytes", key, info, len(value))
+		}
+	}
+	if err := b.Get("chunks/missing", io.Discard); err != ErrNotFound {
+		t.Fatalf("get of a missing key returned %v, want ErrNotFound", err)
+	}
+	if _, err := b.Stat("chunks/missing"); err != ErrNotFound {
+		t.Fatalf("stat of a missing key returned %v, want ErrNotFound", err)
+	}
+
+	listed := func(prefix string, want ...string) {
+		t.Helper()
+		keys, err := b.List(prefix)
+		if err != nil {
+			t.Fatalf("list %q: %v", prefix, err)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != strings.Join(want, ",") {
+			t.Fatalf("list %q returned %v, want %v", prefix, keys, want)
+		}
+	}
+	listed("", "chunks/aa", "chunks/ab", "packs/ac")
+	listed("chunks/", "chunks/aa", "chunks/ab")
+	listed("chunks/ab", "chunks/ab")
+	listed("snapshots/")
+
+	if err := b.Delete("chunks/aa"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("chunks/aa"); err != nil {
+		t.Fatalf("deleting a missing key returned %v", err)
+	}
+	if _, err := b.Stat("chunks/aa"); err != ErrNotFound {
+		t.Fatalf("stat of a deleted key returned %v, want ErrNotFound", err)
+	}
+	listed("chunks/", "chunks/ab")
+}
+
+//the fake every other test stores into must behave like a real backend
+func TestMemBackend(t *testing.T) {
+	testBackend(t, newMemBackend())
+}
+
+//failBackend is a memBackend that refuses every upload
+type failBackend struct {
+	*memBackend
+}
+
+func (b failBackend) Put(key string, r io.Reader) error {
+	return errors.New("disk full")
+}
+
+//a target that fails is reported and left out, the others still get the file
+func TestReplicateSkipsFailedTarget(t *testing.T) {
+	dir := t.TempDir()
+	good, bad := NewRepo(newMemBackend(), 0), NewRepo(failBackend{newMemBackend()}, 0)
+	targets := []Target{{Name: "bad", Repo: bad}, {Name: "good", Repo: good}}
+
+	name := writeRandomFile(t, dir, "file", 1, 3*MinChunkSize)
+	meta, err := FileMeta(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := Replicate(targets, &meta)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "bad: ") {
+		t.Fatalf("got errors %v, want one for bad", errs)
+	}
+	if strings.Join(meta.Targets, ",") != "good" || meta.Hash != Md5file(name) {
+		t.Fatalf("the file is on %v under %v", meta.Targets, meta.Hash)
+	}
+	checkRestore(t, good, meta.Hash, name)
+
+	//the next run only sends the file to the target missing it
+	if errs := Replicate(targets, &meta); len(errs) != 1 {
+		t.Fatalf("got errors %v, want one for bad", errs)
+	}
+	if strings.Join(meta.Targets, ",") != "good" {
+		t.Fatalf("the file is on %v", meta.Targets)
+	}
+}
+
+//write size random bytes made from seed to a file in dir
+func writeRandomFile(t *testing.T, dir string, name string, seed int64, size int) string {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	name = filepath.Join(dir, name)
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+//restore the file stored under key and compare it with the file called want
+func checkRestore(t *testing.T, r *Repo, key string, want string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := r.Restore(key, &buf); err != nil {
+		t.Fatalf("restoring %v: %v", key, err)
+	}
+	data, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("%v restored %v bytes that differ from the %v bytes saved", key, buf.Len(), len(data))
+	}
+}
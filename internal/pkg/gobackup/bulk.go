@@ -0,0 +1,122 @@
+package gobackup
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"unicode/utf8"
+)
+
+//BatchPutter is implemented by backends that can store many values in one request
+//the repo collects chunks, manifests and packs into batches for these backends instead of putting them one at a time
+type BatchPutter interface {
+	//store every item, failing as a whole if any item was not stored
+	PutBatch(items []BatchItem) error
+	//the most items and the most encoded bytes a single batch may hold
+	BatchLimits() (count int, size int64)
+}
+
+//the most value bytes a batch holds in memory before it is sent
+//backends accepting larger requests still flush at this size, so a pending batch stays within two of the largest chunks
+const MaxBatchBytes = 16 << 20
+
+//a value waiting to be stored in a batch
+type BatchItem struct {
+	Key   string
+	Value []byte
+}
+
+//roughly how many bytes the item adds to a request
+func (b BatchItem) size() int64 {
+	n := int64(len(b.Value))
+	if !utf8.Valid(b.Value) {
+		n = int64(base64.StdEncoding.EncodedLen(len(b.Value)))
+	}
+	//the json field names, quotes and escaping
+	return n + int64(len(b.Key)) + 64
+}
+
+//the values waiting to be sent
+type batch struct {
+	items []BatchItem
+	size  int64
+	keys  map[string]bool //keys in items
+	files map[string]bool //files that are only fully stored once the batch is sent
+}
+
+//store data under key, going through the batch when the backend supports it
+//owners are the file keys that depend on the value, they are reported by Flush if its batch fails
+func (r *Repo) put(owners []string, key string, data []byte) error {
+	bp, ok := r.Backend.(BatchPutter)
+	if !ok {
+		return r.Put(key, bytes.NewReader(data))
+	}
+
+	r.batchMu.Lock()
+	defer r.batchMu.Unlock()
+
+	//the caller may reuse data, the batch keeps its own copy
+	item := BatchItem{Key: key, Value: append([]byte(nil), data...)}
+
+	maxCount, maxSize := bp.BatchLimits()
+	if maxSize > MaxBatchBytes {
+		maxSize = MaxBatchBytes
+	}
+	if len(r.batch.items) > 0 && (len(r.batch.items)+1 > maxCount || r.batch.size+item.size() > maxSize) {
+		r.flushBatch(bp)
+	}
+
+	if r.batch.keys == nil {
+		r.batch.keys = map[string]bool{}
+		r.batch.files = map[string]bool{}
+	}
+	r.batch.items = append(r.batch.items, item)
+	r.batch.size += item.size()
+	r.batch.keys[key] = true
+	for _, owner := range owners {
+		r.batch.files[owner] = true
+	}
+	return nil
+}
+
+//record that owner depends on key when key is still waiting in the batch
+//a file that reuses a chunk from an unsent batch is lost with it if the batch fails
+func (r *Repo) joinBatch(owner string, key string) {
+	r.batchMu.Lock()
+	defer r.batchMu.Unlock()
+
+	if r.batch.keys[key] {
+		r.batch.files[owner] = true
+	}
+}
+
+//send the batch, the caller must hold r.batchMu
+//on failure the chunks it held are forgotten so they are uploaded again and its files are reported by Flush
+func (r *Repo) flushBatch(bp BatchPutter) {
+	if len(r.batch.items) == 0 {
+		return
+	}
+	b := r.batch
+	r.batch = batch{}
+
+	err := bp.PutBatch(b.items)
+	if err == nil {
+		fmt.Printf("bulk upload of %v values (%v bytes): ok\n", len(b.items), b.size)
+		r.stateMu.Lock()
+		defer r.stateMu.Unlock()
+		for file := range b.files {
+			r.commit(file)
+		}
+		return
+	}
+	fmt.Printf("bulk upload of %v values (%v bytes): failed: %v\n", len(b.items), b.size, err)
+
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	for key := range b.keys {
+		delete(r.known, key)
+	}
+	for file := range b.files {
+		r.lost = append(r.lost, file)
+	}
+}
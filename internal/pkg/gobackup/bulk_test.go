@@ -0,0 +1,59 @@
+package gobackup
+
+import (
+	"errors"
+	"testing"
+)
+
+//batchBackend is a memBackend with a bulk endpoint that fails the first fail batches
+type batchBackend struct {
+	*memBackend
+	fail int
+}
+
+func (b *batchBackend) PutBatch(items []BatchItem) error {
+	if b.fail > 0 {
+		b.fail--
+		return errors.New("bulk upload refused")
+	}
+	for _, item := range items {
+		b.values[item.Key] = append([]byte(nil), item.Value...)
+	}
+	return nil
+}
+
+func (b *batchBackend) BatchLimits() (int, int64) {
+	return 10000, 100 << 20
+}
+
+//the chunks of a failed batch must be uploaded again by the next file holding them
+//with a key the batch holds hidden keys, which used to leave the chunks marked as stored
+func TestFailedBatchForgetsChunks(t *testing.T) {
+	key, err := NewRepoKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cipher := range []Cipher{nil, key} {
+		b := &batchBackend{memBackend: newMemBackend(), fail: 1}
+		r := NewRepo(b, 0)
+		if cipher != nil {
+			r.SetKey(cipher)
+		}
+		name := writeRandomFile(t, t.TempDir(), "big", 1, 3*MinChunkSize)
+
+		if _, _, _, err := r.SaveFile("first", name); err != nil {
+			t.Fatal(err)
+		}
+		if lost := r.Flush(); len(lost) != 1 || lost[0] != "first" {
+			t.Fatalf("the failed batch lost %v, want [first]", lost)
+		}
+
+		if _, _, _, err := r.SaveFile("second", name); err != nil {
+			t.Fatal(err)
+		}
+		if lost := r.Flush(); len(lost) != 0 {
+			t.Fatalf("lost %v after the second batch", lost)
+		}
+		checkRestore(t, r, "second", name)
+	}
+}
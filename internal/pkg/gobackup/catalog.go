@@ -0,0 +1,296 @@
+package gobackup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	bolt "go.etcd.io/bbolt"
+)
+
+//the catalog used when the Catalog preference is blank
+const DefaultCatalogFile = "catalog.db"
+
+//the file older versions tracked uploads in, it is imported into the catalog once
+const LegacyDataFile = "data.dat"
+
+//the schema version of the catalog, see catalogMigrations
+const CatalogVersion = 1
+
+var (
+	catalogMeta   = []byte("meta")
+	catalogFiles  = []byte("files")  //path + "\x00" + hash -> CatalogEntry
+	catalogHashes = []byte("hashes") //hash + "\x00" + path -> nothing, the index by hash
+	catalogSchema = []byte("version")
+)
+
+//catalogMigrations[i] brings a catalog from version i to version i+1
+//add a step here and raise CatalogVersion to change the schema, older catalogs are upgraded when opened
+var catalogMigrations = []func(tx *bolt.Tx) error{
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{catalogFiles, catalogHashes} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+//CatalogEntry is a version of a file, its path and hash, and the targets holding it
+type CatalogEntry struct {
+	FileRecord
+	Targets []string `json:"targets"`
+}
+
+//the entry as Metadata
+func (e CatalogEntry) Metadata() Metadata {
+	return Metadata{
+		FileName:    Stream(e.Path),
+		Hash:        e.Hash,
+		Size:        e.Size,
+		Atime:       e.ModTime,
+		Permissions: e.Permissions,
+		Notes:       e.Notes,
+		Chunks:      e.Chunks,
+		Codec:       e.Codec,
+		Targets:     e.Targets,
+	}
+}
+
+//Catalog is the local record of every file version that was backed up and where it is stored
+//it is kept in a bbolt database, so each run's changes are committed at once or not at all
+//files are indexed by path and by hash
+type Catalog struct {
+	db *bolt.DB
+}
+
+//open the catalog called name, creating it or upgrading its schema as needed
+//only one run can have the catalog open, another run waiting for it gives up after a few seconds
+func OpenCatalog(name string) (*Catalog, error) {
+	db, err := bolt.Open(name, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%v is in use by another run", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(catalogMeta)
+		if err != nil {
+			return err
+		}
+		version := 0
+		if v := meta.Get(catalogSchema); v != nil {
+			if version, err = strconv.Atoi(string(v)); err != nil {
+				return fmt.Errorf("bad schema version %q", v)
+			}
+		}
+		if version > CatalogVersion {
+			return fmt.Errorf("schema version %v is newer than this version of goLocBackup understands", version)
+		}
+		for ; version < CatalogVersion; version++ {
+			if err := catalogMigrations[version](tx); err != nil {
+				return err
+			}
+		}
+		return meta.Put(catalogSchema, []byte(strconv.Itoa(version)))
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	return &Catalog{db: db}, nil
+}
+
+//close the database
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
+
+//the key of a file version, paths may hold any character but NUL
+func catalogKey(first string, second string) []byte {
+	return []byte(first + "\x00" + second)
+}
+
+//get the version of the file at path with hash
+func (c *Catalog) Lookup(path string, hash string) (CatalogEntry, bool, error) {
+	var entry CatalogEntry
+	found := false
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(catalogFiles).Get(catalogKey(path, hash))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &entry)
+	})
+	return entry, found, err
+}
+
+//find the version of the file at path with size and modTime
+//a file whose size and modification time still match was not changed since, so it does not have to be read again
+func (c *Catalog) Unchanged(path string, size int64, modTime time.Time) (CatalogEntry, bool, error) {
+	entries, err := c.ByPath(path)
+	if err != nil {
+		return CatalogEntry{}, false, err
+	}
+	for _, e := range entries {
+		if e.Size == size && e.ModTime.Equal(modTime) {
+			return e, true, nil
+		}
+	}
+	return CatalogEntry{}, false, nil
+}
+
+//every version of the file at path
+func (c *Catalog) ByPath(path string) ([]CatalogEntry, error) {
+	var entries []CatalogEntry
+	err := c.db.View(func(tx *bolt.Tx) error {
+		prefix := catalogKey(path, "")
+		cur := tx.Bucket(catalogFiles).Cursor()
+		for k, v := cur.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = cur.Next() {
+			var entry CatalogEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("%q: %v", k, err)
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+//every file version with hash, there is one for each path the content was backed up from
+func (c *Catalog) ByHash(hash string) ([]CatalogEntry, error) {
+	var entries []CatalogEntry
+	err := c.db.View(func(tx *bolt.Tx) error {
+		prefix := catalogKey(hash, "")
+		files := tx.Bucket(catalogFiles)
+		cur := tx.Bucket(catalogHashes).Cursor()
+		for k, _ := cur.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = cur.Next() {
+			path := strings.TrimPrefix(string(k), string(prefix))
+			var entry CatalogEntry
+			if err := json.Unmarshal(files.Get(catalogKey(path, hash)), &entry); err != nil {
+				return fmt.Errorf("%v %v: %v", path, hash, err)
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+//record files in a single transaction
+//a file version already in the catalog is recorded again from meta, keeping the targets it had and gaining those in meta.Targets
+//files stored on no target are left out, so the next run tries them again
+func (c *Catalog) Add(files []Metadata) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(catalogFiles)
+		index := tx.Bucket(catalogHashes)
+		for _, meta := range files {
+			if len(meta.Targets) == 0 {
+				continue
+			}
+			path := string(meta.FileName)
+			key := catalogKey(path, meta.Hash)
+
+			entry := CatalogEntry{FileRecord: fileRecord(meta)}
+			if v := bucket.Get(key); v != nil {
+				//a touched file keeps its hash, its new time and permissions are what the next run compares with
+				var old CatalogEntry
+				if err := json.Unmarshal(v, &old); err != nil {
+					return fmt.Errorf("%v %v: %v", path, meta.Hash, err)
+				}
+				entry.Targets = old.Targets
+			}
+			for _, t := range meta.Targets {
+				if !HasTarget(Metadata{Targets: entry.Targets}, t) {
+					entry.Targets = append(entry.Targets, t)
+				}
+			}
+
+			doc, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(key, doc); err != nil {
+				return err
+			}
+			if err := index.Put(catalogKey(meta.Hash, path), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//add the files listed in a data file written by an older version
+//both the "hash:filename:f1o1:notes:time" lines and the TOML form of Data1 are read
+//returns how many file versions were read
+func (c *Catalog) ImportDataFile(name string) (int, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+
+	var files []Metadata
+	var old Data1
+	if toml.Unmarshal(data, &old) == nil && len(old.TheMetadata) > 0 {
+		files = old.TheMetadata
+	} else {
+		scan := bufio.NewScanner(strings.NewReader(string(data)))
+		for scan.Scan() {
+			meta, ok := parseDataLine(scan.Text())
+			if ok {
+				files = append(files, meta)
+			}
+		}
+	}
+
+	//data.dat was written when Workers KV was the only backend
+	for i := range files {
+		files[i].Targets = []string{"kv"}
+	}
+	return len(files), c.Add(files)
+}
+
+//the file number and the time at the end of a data.dat line, the filename and notes before them may hold colons
+var (
+	dataFileNum = regexp.MustCompile(`:(f\d+o\d+):`)
+	dataTime    = regexp.MustCompile(`\d{4}-\d\d-\d\d \d\d:\d\d:\d\d(\.\d+)? [+-]\d{4} \S+$`)
+)
+
+//read a "hash:filename:f1o1:notes:time" line from data.dat
+func parseDataLine(line string) (Metadata, bool) {
+	var meta Metadata
+	if len(line) < 33 || line[32] != ':' || !isMd5(line[:32]) {
+		return meta, false
+	}
+	meta.Hash, line = line[:32], line[33:]
+
+	//the last file number, a colon in a filename is far more likely than a file number in the notes
+	nums := dataFileNum.FindAllStringSubmatchIndex(line, -1)
+	if nums == nil {
+		return meta, false
+	}
+	num := nums[len(nums)-1]
+	meta.FileName = Stream(line[:num[0]])
+	meta.FileNum = line[num[2]:num[3]]
+	rest := line[num[1]:]
+
+	if t := dataTime.FindStringIndex(rest); t != nil && t[0] > 0 {
+		meta.Notes = rest[:t[0]-1]
+		meta.Atime, _ = time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", rest[t[0]:])
+	} else {
+		meta.Notes = rest
+	}
+	return meta, meta.FileName != ""
+}
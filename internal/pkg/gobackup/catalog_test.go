@@ -0,0 +1,171 @@
+package gobackup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestCatalog(t *testing.T, name string) *Catalog {
+	t.Helper()
+	c, err := OpenCatalog(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+//file versions are found by path and hash, and again after the catalog is reopened
+func TestCatalog(t *testing.T) {
+	name := filepath.Join(t.TempDir(), DefaultCatalogFile)
+	c := openTestCatalog(t, name)
+
+	hash1, hash2 := "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+	modTime := time.Date(2026, 10, 13, 8, 30, 0, 123456789, time.FixedZone("CEST", 2*3600))
+	files := []Metadata{
+		{FileName: "/home/a.txt", Hash: hash1, Size: 10, Atime: modTime, Permissions: "-rw-r--r--", Chunks: []string{"c1"}, Codec: CodecZstd, Targets: []string{"dir"}},
+		{FileName: "/home/a.txt", Hash: hash2, Size: 20, Atime: modTime.Add(time.Hour), Targets: []string{"kv"}},
+		{FileName: "/home/copy of a.txt", Hash: hash1, Size: 10, Atime: modTime, Targets: []string{"dir"}},
+		//stored nowhere, the next run tries it again
+		{FileName: "/home/failed.txt", Hash: hash2, Size: 20, Atime: modTime},
+	}
+	if err := c.Add(files); err != nil {
+		t.Fatal(err)
+	}
+	//a version stored again after it was touched gains the new target and the new time
+	touched := files[0]
+	touched.Atime = modTime.Add(time.Minute)
+	touched.Targets = []string{"kv", "dir"}
+	if err := c.Add([]Metadata{touched}); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c = openTestCatalog(t, name)
+
+	entry, found, err := c.Lookup("/home/a.txt", hash1)
+	if err != nil || !found {
+		t.Fatalf("a.txt was not found: %v", err)
+	}
+	if strings.Join(entry.Targets, ",") != "dir,kv" || entry.Codec != CodecZstd || len(entry.Chunks) != 1 || !entry.ModTime.Equal(touched.Atime) {
+		t.Fatalf("a.txt was recorded as %+v", entry)
+	}
+	if meta := entry.Metadata(); meta.FileName != "/home/a.txt" || meta.Hash != hash1 || meta.Permissions != "-rw-r--r--" {
+		t.Fatalf("a.txt reads back as %+v", meta)
+	}
+	if _, found, _ := c.Lookup("/home/failed.txt", hash2); found {
+		t.Fatal("a file stored nowhere was recorded")
+	}
+
+	versions, err := c.ByPath("/home/a.txt")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("a.txt has %v versions: %v", len(versions), err)
+	}
+	//a path that starts with another is not one of its versions
+	if versions, _ := c.ByPath("/home/a"); len(versions) != 0 {
+		t.Fatalf("/home/a has %v versions", len(versions))
+	}
+	copies, err := c.ByHash(hash1)
+	if err != nil || len(copies) != 2 {
+		t.Fatalf("%v is at %v paths: %v", hash1, len(copies), err)
+	}
+
+	//the modification time is compared as an instant, whatever its zone
+	if entry, found, err := c.Unchanged("/home/a.txt", 10, touched.Atime.UTC()); err != nil || !found || entry.Hash != hash1 {
+		t.Fatalf("unchanged a.txt was not found: %v %v", entry.Hash, err)
+	}
+	if _, found, _ := c.Unchanged("/home/a.txt", 11, touched.Atime); found {
+		t.Fatal("a file of another size was unchanged")
+	}
+	if _, found, _ := c.Unchanged("/home/a.txt", 10, modTime); found {
+		t.Fatal("a file with its time before it was touched was unchanged")
+	}
+}
+
+//a catalog written by a newer version is not touched
+func TestCatalogNewerSchema(t *testing.T) {
+	name := filepath.Join(t.TempDir(), DefaultCatalogFile)
+	c := openTestCatalog(t, name)
+	c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(catalogMeta).Put(catalogSchema, []byte("99"))
+	})
+	c.Close()
+	if _, err := OpenCatalog(name); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("opening a newer catalog returned %v", err)
+	}
+}
+
+//the data.dat of older versions is read, colons in names and notes included
+func TestImportDataFile(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, LegacyDataFile)
+	hash1, hash2 := "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+	lines := []string{
+		hash1 + ":C:/Users/me/notes: today.txt:f1o1:a note: with colons:2021-03-04 05:06:07.123 +0000 UTC",
+		hash2 + ":big.iso:f1o1::2021-03-04 05:06:07 +0100 CET",
+		"not a line of the data file",
+	}
+	os.WriteFile(data, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	c := openTestCatalog(t, filepath.Join(dir, DefaultCatalogFile))
+	n, err := c.ImportDataFile(data)
+	if err != nil || n != 2 {
+		t.Fatalf("read %v files: %v", n, err)
+	}
+
+	entry, found, err := c.Lookup("C:/Users/me/notes: today.txt", hash1)
+	if err != nil || !found {
+		t.Fatalf("the file with colons was not found: %v", err)
+	}
+	if entry.Notes != "a note: with colons" || strings.Join(entry.Targets, ",") != "kv" ||
+		!entry.ModTime.Equal(time.Date(2021, 3, 4, 5, 6, 7, 123000000, time.UTC)) {
+		t.Fatalf("read as %+v", entry)
+	}
+	entry, found, _ = c.Lookup("big.iso", hash2)
+	if !found || entry.Notes != "" || strings.Join(entry.Targets, ",") != "kv" {
+		t.Fatalf("the file without notes was read as %+v", entry)
+	}
+}
+
+//a file that was only touched is read and stored once more, after that it is unchanged again
+func TestCatalogTouchedFile(t *testing.T) {
+	dir := t.TempDir()
+	c := openTestCatalog(t, filepath.Join(dir, DefaultCatalogFile))
+	targets := []Target{{Name: "mem", Repo: NewRepo(newMemBackend(), 0)}}
+	name := writeRandomFile(t, dir, "file", 1, 1000)
+
+	backup := func() {
+		t.Helper()
+		meta, err := FileMeta(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, found, err := c.Unchanged(name, meta.Size, meta.Atime); err != nil || found {
+			t.Fatalf("a new or touched file was unchanged: %v", err)
+		}
+		if errs := Replicate(targets, &meta); len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		if err := c.Add([]Metadata{meta}); err != nil {
+			t.Fatal(err)
+		}
+		meta, _ = FileMeta(name)
+		if _, found, err := c.Unchanged(name, meta.Size, meta.Atime); err != nil || !found {
+			t.Fatalf("the file was not unchanged after it was stored: %v", err)
+		}
+	}
+	backup()
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(name, later, later); err != nil {
+		t.Fatal(err)
+	}
+	backup()
+
+	if versions, err := c.ByPath(name); err != nil || len(versions) != 1 {
+		t.Fatalf("touching the file made %v versions: %v", len(versions), err)
+	}
+}
@@ -0,0 +1,120 @@
+package gobackup
+
+import (
+	"io"
+)
+
+//chunk size limits for content defined chunking
+//the maximum stays well under MaxValueSize so every chunk fits in a single value
+const (
+	MinChunkSize = 512 << 10
+	AvgChunkSize = 1 << 20
+	MaxChunkSize = 8 << 20
+)
+
+//cut point masks for normalized chunking, FastCDC section 3.3
+//before the average size a harder mask (22 bits) is used and after it an easier one (18 bits),
+//which pulls most chunk sizes close to AvgChunkSize
+const (
+	maskHard = uint64(1<<22-1) << (64 - 22)
+	maskEasy = uint64(1<<18-1) << (64 - 18)
+)
+
+//random values for the gear rolling hash
+//the table must never change, a different table moves every cut point and defeats deduplication
+var gear [256]uint64
+
+func init() {
+	//splitmix64 with a fixed seed
+	seed := uint64(0x676f4261636b7570) //"goBackup"
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+//Chunker splits a stream into content defined chunks using a FastCDC style gear hash
+//the same data produces the same chunks wherever it appears, so an edit only changes the chunks around it
+type Chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int //first unread byte of buf
+	end   int //end of the data in buf
+	eof   bool
+}
+
+//create a chunker reading from r
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 2*MaxChunkSize)}
+}
+
+//return the next chunk, or io.EOF once the stream is finished
+//the chunk is only valid until the next call to Next
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	data := c.buf[c.start:c.end]
+	cut := cutPoint(data)
+	c.start += cut
+	return data[:cut], nil
+}
+
+//make sure at least MaxChunkSize bytes are buffered unless the stream has ended
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= MaxChunkSize {
+		return nil
+	}
+
+	//move the remaining data to the front of the buffer
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	n, err := io.ReadFull(c.r, c.buf[c.end:])
+	c.end += n
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.eof = true
+		return nil
+	}
+	return err
+}
+
+//find where the first chunk in data ends
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= MinChunkSize {
+		return n
+	}
+	if n > MaxChunkSize {
+		n = MaxChunkSize
+	}
+	normal := AvgChunkSize
+	if n < normal {
+		normal = n
+	}
+
+	//the first MinChunkSize bytes can never be a cut point so they are skipped
+	var fp uint64
+	i := MinChunkSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskHard == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskEasy == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
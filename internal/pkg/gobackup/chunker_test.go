@@ -0,0 +1,155 @@
+package gobackup
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+//split data into chunks, each copied out of the chunker's buffer
+func chunks(t *testing.T, r io.Reader) [][]byte {
+	t.Helper()
+	var out [][]byte
+	c := NewChunker(r)
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, append([]byte(nil), data...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 12<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	//the cut points of stored backups, a change here breaks deduplication against them
+	var cuts []int
+	end := 0
+	for _, chunk := range chunks(t, bytes.NewReader(data)) {
+		end += len(chunk)
+		cuts = append(cuts, end)
+	}
+	want := []int{1432517, 2520956, 3590884, 4682512, 5734541, 6921878, 8163784, 9697691, 10868158, 12044996, 12582912}
+	if len(cuts) != len(want) {
+		t.Fatalf("cut at %v, want %v", cuts, want)
+	}
+	for i := range want {
+		if cuts[i] != want[i] {
+			t.Fatalf("cut at %v, want %v", cuts, want)
+		}
+	}
+
+	//short reads do not move the cut points
+	half := chunks(t, iotest.HalfReader(bytes.NewReader(data)))
+	if len(half) != len(cuts) || !bytes.Equal(bytes.Join(half, nil), data) {
+		t.Fatalf("a reader giving short reads made %v chunks, want %v", len(half), len(cuts))
+	}
+
+	//every chunk but the last is within the limits
+	same := bytes.Repeat([]byte{7}, 3*MaxChunkSize+5)
+	got := chunks(t, bytes.NewReader(same))
+	for i, chunk := range got {
+		if len(chunk) > MaxChunkSize || (i < len(got)-1 && len(chunk) < MinChunkSize) {
+			t.Fatalf("chunk %v of %v has %v bytes", i, len(got), len(chunk))
+		}
+	}
+	if !bytes.Equal(bytes.Join(got, nil), same) {
+		t.Fatal("the chunks do not add up to the data")
+	}
+
+	if got := chunks(t, bytes.NewReader(nil)); len(got) != 0 {
+		t.Fatalf("no data made %v chunks", len(got))
+	}
+	if got := chunks(t, bytes.NewReader([]byte("small"))); len(got) != 1 || string(got[0]) != "small" {
+		t.Fatalf("a small stream made %q", got)
+	}
+	if _, err := NewChunker(iotest.ErrReader(io.ErrClosedPipe)).Next(); err != io.ErrClosedPipe {
+		t.Fatalf("a failing reader returned %v", err)
+	}
+}
+
+//inserting data only changes the chunks around it
+func TestChunkerShift(t *testing.T) {
+	data := make([]byte, 12<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	edited := append(append(append([]byte(nil), data[:5<<20]...), "inserted"...), data[5<<20:]...)
+
+	before := map[string]bool{}
+	for _, chunk := range chunks(t, bytes.NewReader(data)) {
+		before[chunkHash(chunk)] = true
+	}
+	after := chunks(t, bytes.NewReader(edited))
+	changed := 0
+	for _, chunk := range after {
+		if !before[chunkHash(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("inserting 8 bytes changed %v of %v chunks", changed, len(after))
+	}
+}
+
+//a file stored again after an edit only uploads the chunks that changed, and both versions restore
+func TestChunkedRepo(t *testing.T) {
+	dir := t.TempDir()
+	b := newMemBackend()
+	r := NewRepo(b, 0)
+	compression, err := ParseCompression("zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetCompression(compression)
+
+	//text compresses, so the chunks are stored compressed
+	text := []byte(strings.Repeat("every line of a log file looks much like the last one\n", 200000))
+	random := make([]byte, 6<<20)
+	rand.New(rand.NewSource(3)).Read(random)
+	first := filepath.Join(dir, "first")
+	os.WriteFile(first, append(text, random...), 0644)
+	key, hashes, codec, err := r.SaveFile("", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec != CodecZstd || len(hashes) < 3 {
+		t.Fatalf("stored as %v chunks with codec %q", len(hashes), codec)
+	}
+
+	edited := append(append([]byte(nil), text...), random...)
+	copy(edited[len(text)+3<<20:], "edited")
+	second := filepath.Join(dir, "second")
+	os.WriteFile(second, edited, 0644)
+	stored := len(b.values)
+	key2, hashes2, _, err := r.SaveFile("", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the manifest and the chunks around the edit
+	if added := len(b.values) - stored; added > 3 {
+		t.Fatalf("an edit added %v values for a file of %v chunks", added, len(hashes2))
+	}
+
+	again := NewRepo(b, 0)
+	checkRestore(t, again, key, first)
+	checkRestore(t, again, key2, second)
+
+	//a file with a damaged chunk is not restored
+	for k, v := range b.values {
+		if k != key && k != key2 {
+			b.values[k] = append(v[:len(v)-1:len(v)-1], v[len(v)-1]^1)
+		}
+	}
+	if err := again.Restore(key, io.Discard); err == nil {
+		t.Fatal("a file with damaged chunks was restored")
+	}
+}
@@ -0,0 +1,163 @@
+package gobackup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//the codecs values can be compressed with, recorded in Metadata, manifests and pack indexes
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+//how much of a file is compressed to decide whether the whole file is worth compressing
+const compressSample = 64 << 10
+
+//files whose sample does not shrink below this fraction of its size are stored as they are
+//jpg, mp4, zip and other already compressed formats land here
+const compressMinRatio = 0.9
+
+//Compression is the codec and level set with the Zip preference
+type Compression struct {
+	Codec string
+	Level int //0 uses the codec's default level
+
+	zstd *zstd.Encoder //made on first use
+	once sync.Once
+	err  error
+}
+
+//parse the Zip preference, "codec" or "codec:level" with a codec of none, gzip or zstd
+//blank stores values uncompressed
+func ParseCompression(pref string) (*Compression, error) {
+	codec, level, hasLevel := strings.Cut(strings.ToLower(strings.TrimSpace(pref)), ":")
+	c := &Compression{Codec: codec}
+	if codec == "" {
+		c.Codec = CodecNone
+	}
+
+	if hasLevel {
+		var err error
+		if c.Level, err = strconv.Atoi(level); err != nil {
+			return nil, fmt.Errorf("zip: bad level %q", level)
+		}
+	}
+
+	switch c.Codec {
+	case CodecNone:
+	case CodecGzip:
+		if c.Level < 0 || c.Level > gzip.BestCompression {
+			return nil, fmt.Errorf("zip: gzip levels are 1 to %v", gzip.BestCompression)
+		}
+	case CodecZstd:
+		if c.Level < 0 || c.Level > 22 {
+			return nil, fmt.Errorf("zip: zstd levels are 1 to 22")
+		}
+	default:
+		return nil, fmt.Errorf("zip: unknown codec %q, use none, gzip or zstd", c.Codec)
+	}
+	return c, nil
+}
+
+//the codec to store a file with, given its first bytes
+//none when compression is off or the sample does not compress
+func (c *Compression) codecFor(sample []byte) string {
+	if c == nil || c.Codec == CodecNone || len(sample) == 0 {
+		return CodecNone
+	}
+	if len(sample) > compressSample {
+		sample = sample[:compressSample]
+	}
+	packed, err := c.compress(c.Codec, sample)
+	if err != nil || float64(len(packed)) > compressMinRatio*float64(len(sample)) {
+		return CodecNone
+	}
+	return c.Codec
+}
+
+//compress data with codec at the configured level
+func (c *Compression) compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone, "":
+		return data, nil
+	case CodecGzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		var out bytes.Buffer
+		w, err := gzip.NewWriterLevel(&out, level)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	case CodecZstd:
+		c.once.Do(func() {
+			level := zstd.SpeedDefault
+			if c.Level != 0 {
+				level = zstd.EncoderLevelFromZstd(c.Level)
+			}
+			c.zstd, c.err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+		})
+		if c.err != nil {
+			return nil, c.err
+		}
+		return c.zstd.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
+
+//decoders are safe to share, one is made on first use
+var (
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderOnce sync.Once
+	zstdDecoderErr  error
+)
+
+//undo compress
+func decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone, "":
+		return data, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case CodecZstd:
+		zstdDecoderOnce.Do(func() {
+			zstdDecoder, zstdDecoderErr = zstd.NewReader(nil)
+		})
+		if zstdDecoderErr != nil {
+			return nil, zstdDecoderErr
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
+
+//the name a chunk stored with codec goes by
+//uncompressed chunks keep their hash, compressed ones get a name of the same length per codec
+//so a file never picks up a chunk stored with a different codec than its manifest records
+func chunkName(hash string, codec string) string {
+	if codec == CodecNone || codec == "" {
+		return hash
+	}
+	return chunkHash([]byte(codec + ":" + hash))
+}
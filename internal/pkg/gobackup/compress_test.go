@@ -0,0 +1,144 @@
+package gobackup
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCompression(t *testing.T) {
+	for _, want := range []struct {
+		pref  string
+		codec string
+		level int
+	}{
+		{"", CodecNone, 0},
+		{"none", CodecNone, 0},
+		{"gzip", CodecGzip, 0},
+		{"GZIP:9", CodecGzip, 9},
+		{" zstd:19", CodecZstd, 19},
+	} {
+		c, err := ParseCompression(want.pref)
+		if err != nil || c.Codec != want.codec || c.Level != want.level {
+			t.Errorf("%q parsed as %+v: %v", want.pref, c, err)
+		}
+	}
+	for _, pref := range []string{"lz4", "gzip:10", "gzip:-1", "zstd:23", "zstd:fast", "zstd:"} {
+		if _, err := ParseCompression(pref); err == nil {
+			t.Errorf("%q was accepted", pref)
+		}
+	}
+}
+
+//only the first 64KB decide, data that does not shrink below 90% of its size is stored as it is
+func TestCodecFor(t *testing.T) {
+	random := make([]byte, 4*compressSample)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := []byte(strings.Repeat("the same words over and over again\n", 10000))
+
+	c, err := ParseCompression("zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec := c.codecFor(random); codec != CodecNone {
+		t.Errorf("random data is stored with %v", codec)
+	}
+	if codec := c.codecFor(text); codec != CodecZstd {
+		t.Errorf("text is stored with %v", codec)
+	}
+	//the part after the sample is not looked at
+	if codec := c.codecFor(append(append([]byte(nil), random[:compressSample]...), text...)); codec != CodecNone {
+		t.Errorf("a file starting with random data is stored with %v", codec)
+	}
+	if codec := c.codecFor(append(append([]byte(nil), text[:compressSample]...), random...)); codec != CodecZstd {
+		t.Errorf("a file starting with text is stored with %v", codec)
+	}
+
+	//a quarter of the sample compressible shrinks it to about 75%, a twentieth only to about 95%
+	quarter := append(make([]byte, compressSample/4), random[:compressSample*3/4]...)
+	if codec := c.codecFor(quarter); codec != CodecZstd {
+		t.Errorf("a sample shrinking to 75%% is stored with %v", codec)
+	}
+	twentieth := append(make([]byte, compressSample/20), random[:compressSample*19/20]...)
+	if codec := c.codecFor(twentieth); codec != CodecNone {
+		t.Errorf("a sample shrinking to 95%% is stored with %v", codec)
+	}
+
+	var off *Compression
+	if codec := off.codecFor(text); codec != CodecNone {
+		t.Errorf("no compression stores text with %v", codec)
+	}
+	if codec := c.codecFor(nil); codec != CodecNone {
+		t.Errorf("an empty file is stored with %v", codec)
+	}
+}
+
+//each codec gets names of its own, of the same length as the hash
+func TestChunkName(t *testing.T) {
+	hash := chunkHash([]byte("chunk"))
+	if chunkName(hash, CodecNone) != hash || chunkName(hash, "") != hash {
+		t.Error("an uncompressed chunk is not stored under its hash")
+	}
+	gz, zs := chunkName(hash, CodecGzip), chunkName(hash, CodecZstd)
+	if gz == hash || zs == hash || gz == zs {
+		t.Errorf("the codecs share names: %v %v %v", hash, gz, zs)
+	}
+	if len(gz) != len(hash) || len(zs) != len(hash) {
+		t.Errorf("compressed chunks are named %v and %v", gz, zs)
+	}
+	if chunkName(hash, CodecZstd) != zs {
+		t.Error("a chunk name changed between calls")
+	}
+}
+
+//files are stored compressed with each codec, chunked or packed, and restore unchanged
+func TestCompressedRepo(t *testing.T) {
+	dir := t.TempDir()
+	text := []byte(strings.Repeat("every line of a log file looks much like the last one\n", 100000))
+	large := filepath.Join(dir, "large.log")
+	os.WriteFile(large, text, 0644)
+	small := filepath.Join(dir, "small.log")
+	os.WriteFile(small, text[:2000], 0644)
+	photo := writeRandomFile(t, dir, "photo.jpg", 1, 100000)
+
+	for _, pref := range []string{"gzip", "zstd:3"} {
+		c, err := ParseCompression(pref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := newMemBackend()
+		r := NewRepo(b, 1<<20)
+		r.SetCompression(c)
+
+		files := []struct{ name, codec string }{{large, c.Codec}, {small, c.Codec}, {photo, CodecNone}}
+		keys := make([]string, len(files))
+		for i, f := range files {
+			key, _, codec, err := r.SaveFile("", f.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec != f.codec {
+				t.Errorf("%v: %v was stored with %v", pref, filepath.Base(f.name), codec)
+			}
+			keys[i] = key
+		}
+		if lost := r.Flush(); len(lost) != 0 {
+			t.Fatalf("lost %v", lost)
+		}
+
+		stored := 0
+		for _, v := range b.values {
+			stored += len(v)
+		}
+		if stored > len(text)/4 {
+			t.Errorf("%v: %v bytes of text took %v bytes", pref, len(text), stored)
+		}
+
+		again := NewRepo(b, 1<<20)
+		for i, f := range files {
+			checkRestore(t, again, keys[i], f.name)
+		}
+	}
+}
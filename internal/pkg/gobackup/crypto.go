@@ -0,0 +1,303 @@
+package gobackup
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+//returned when an encrypted value fails authentication
+//the value was changed after it was written, or it was encrypted with a different key
+var ErrTampered = errors.New("gobackup: encrypted value failed authentication")
+
+//Cipher encrypts the values of a repository and hides the content hashes they are stored under
+//RepoKey encrypts with a secret key opened by a passphrase, AgeKey encrypts to age public keys
+type Cipher interface {
+	//encrypt and authenticate plaintext, binding it to name
+	Seal(name string, plaintext []byte) ([]byte, error)
+	//decrypt a value made by Seal for the same name
+	Open(name string, sealed []byte) ([]byte, error)
+	//the key the value named by the content hash name is stored under
+	HideName(name string) string
+}
+
+//RepoKey holds the secret keys of an encrypted repository
+//it is never stored in the clear, see KeyFile
+type RepoKey struct {
+	Encrypt []byte `json:"encrypt"` //AES-256-GCM key for every stored value
+	//HMAC-SHA256 key hiding the content hashes values are stored under
+	//keys created before it was added leave it empty and keep storing values under the plain hashes
+	MAC []byte `json:"mac,omitempty"`
+	//encryption keys replaced by RotateKey, values they sealed can still be opened
+	Old []RepoKey `json:"old,omitempty"`
+}
+
+//create a repository key from random bytes
+func NewRepoKey() (*RepoKey, error) {
+	key := &RepoKey{Encrypt: make([]byte, 32), MAC: make([]byte, 32)}
+	if _, err := io.ReadFull(rand.Reader, key.Encrypt); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, key.MAC); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//the key a value named by the content hash name is stored under
+//a keyed MAC replaces the hash so nobody without the key can check whether a known file or chunk is stored
+//the result is as long as name, so manifest and chunk keys still cannot collide
+func (k *RepoKey) HideName(name string) string {
+	if len(k.MAC) == 0 {
+		return name
+	}
+	mac := hmac.New(sha256.New, k.MAC)
+	mac.Write([]byte(name))
+	return hashToString(mac.Sum(nil)[:len(name)/2])
+}
+
+//the version byte at the front of every encrypted value
+const sealVersion = 1
+
+func (k *RepoKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//encrypt and authenticate plaintext with AES-256-GCM
+//name is authenticated too, normally the key the value is stored under, so a value moved to another key is rejected
+//the result is version byte | 12 byte nonce | ciphertext and tag
+func (k *RepoKey) Seal(name string, plaintext []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out[0] = sealVersion
+	if _, err := io.ReadFull(rand.Reader, out[1:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[1:], plaintext, []byte(name)), nil
+}
+
+//decrypt a value made by Seal with this key or one it replaced, returns ErrTampered if it does not authenticate
+func (k *RepoKey) Open(name string, sealed []byte) ([]byte, error) {
+	plaintext, err := k.open(name, sealed)
+	for i := 0; err == ErrTampered && i < len(k.Old); i++ {
+		plaintext, err = k.Old[i].open(name, sealed)
+	}
+	return plaintext, err
+}
+
+func (k *RepoKey) open(name string, sealed []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 1+aead.NonceSize()+aead.Overhead() || sealed[0] != sealVersion {
+		return nil, ErrTampered
+	}
+
+	nonce := sealed[1 : 1+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[1+aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return plaintext, nil
+}
+
+//Argon2id settings used for new key slots
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 //KiB
+	argonThreads = 4
+)
+
+//the current key file version, version 1 files held a single unnamed slot
+const KeyFileVersion = 2
+
+//KeyFile stores the repository key wrapped once for every passphrase that may open it
+//it is safe to keep next to the backups, without a passphrase it reveals nothing
+type KeyFile struct {
+	Version int       `json:"version"`
+	Slots   []KeySlot `json:"slots"`
+}
+
+//KeySlot is the repository key wrapped with a key derived from one passphrase
+type KeySlot struct {
+	ID       string    `json:"id"`
+	Label    string    `json:"label"`
+	Recovery bool      `json:"recovery,omitempty"` //opened with a generated recovery key instead of a passphrase
+	Created  time.Time `json:"created"`
+	KDF      string    `json:"kdf"`
+	Time     uint32    `json:"time"`
+	Memory   uint32    `json:"memory"`
+	Threads  uint8     `json:"threads"`
+	Salt     []byte    `json:"salt"`
+	Key      []byte    `json:"key"` //the RepoKey as json, sealed with the derived key
+}
+
+//parse a key file, upgrading a version 1 file to a single slot
+func ParseKeyFile(data []byte) (*KeyFile, error) {
+	var kf KeyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, err
+	}
+	switch kf.Version {
+	case 1:
+		var slot KeySlot
+		if err := json.Unmarshal(data, &slot); err != nil {
+			return nil, err
+		}
+		slot.ID, slot.Label = "1", "passphrase"
+		kf = KeyFile{Version: KeyFileVersion, Slots: []KeySlot{slot}}
+	case KeyFileVersion:
+	default:
+		return nil, fmt.Errorf("unsupported key file version %v", kf.Version)
+	}
+	return &kf, nil
+}
+
+//derive the key encryption key from passphrase
+func (s *KeySlot) derive(passphrase string) (*RepoKey, error) {
+	if s.KDF != "argon2id" {
+		return nil, fmt.Errorf("unsupported key derivation %q", s.KDF)
+	}
+	return &RepoKey{Encrypt: argon2.IDKey([]byte(passphrase), s.Salt, s.Time, s.Memory, s.Threads, 32)}, nil
+}
+
+//recover the repository key from the slot with passphrase
+func (s *KeySlot) unwrap(passphrase string) (*RepoKey, error) {
+	if s.Recovery {
+		passphrase = normalizeRecoveryKey(passphrase)
+	}
+	kek, err := s.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := kek.Open("gobackup key", s.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var key RepoKey
+	if err := json.Unmarshal(plain, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+//create a key file with a single slot opened by passphrase
+func WrapKey(key *RepoKey, label string, passphrase string) (*KeyFile, error) {
+	kf := &KeyFile{Version: KeyFileVersion}
+	_, err := kf.AddSlot(key, label, passphrase, false)
+	return kf, err
+}
+
+//wrap key with a key derived from passphrase using Argon2id and add it as a new slot
+//a recovery slot expects a key made by NewRecoveryKey as its passphrase
+func (kf *KeyFile) AddSlot(key *RepoKey, label string, passphrase string, recovery bool) (*KeySlot, error) {
+	slot := KeySlot{Label: label, Recovery: recovery, Created: time.Now().UTC(), KDF: "argon2id",
+		Time: argonTime, Memory: argonMemory, Threads: argonThreads, Salt: make([]byte, 16)}
+	if _, err := io.ReadFull(rand.Reader, slot.Salt); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	slot.ID = hashToString(id)
+
+	if recovery {
+		passphrase = normalizeRecoveryKey(passphrase)
+	}
+	kek, err := slot.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	if slot.Key, err = kek.Seal("gobackup key", plain); err != nil {
+		return nil, err
+	}
+
+	kf.Slots = append(kf.Slots, slot)
+	return &kf.Slots[len(kf.Slots)-1], nil
+}
+
+//remove the slot with id, the last slot cannot be removed
+func (kf *KeyFile) RemoveSlot(id string) error {
+	for i, s := range kf.Slots {
+		if s.ID != id {
+			continue
+		}
+		if len(kf.Slots) == 1 {
+			return errors.New("cannot remove the only key slot")
+		}
+		kf.Slots = append(kf.Slots[:i], kf.Slots[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("no key slot %q", id)
+}
+
+//recover the repository key with passphrase, trying every slot
+//returns the slot that opened
+func (kf *KeyFile) Unwrap(passphrase string) (*RepoKey, *KeySlot, error) {
+	for i := range kf.Slots {
+		key, err := kf.Slots[i].unwrap(passphrase)
+		if err == ErrTampered {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &kf.Slots[i], nil
+	}
+	return nil, nil, errors.New("wrong passphrase or damaged key file")
+}
+
+//the alphabet recovery keys are written in, without the letters easily misread on paper
+const recoveryAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+//create a random recovery key to print or write down, 32 characters in groups of four
+func NewRecoveryKey() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for i, b := range raw {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(recoveryAlphabet[int(b)%len(recoveryAlphabet)])
+	}
+	return sb.String(), nil
+}
+
+//drop the spaces and dashes from a typed recovery key and ignore case
+func normalizeRecoveryKey(s string) string {
+	s = strings.ToUpper(s)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,353 @@
+package gobackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//a sealed value only opens under its own name with its own key, any change to it is caught
+func TestSealOpen(t *testing.T) {
+	key, err := NewRepoKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRepoKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, plaintext := range [][]byte{nil, []byte("a value"), bytes.Repeat([]byte{0}, 100000)} {
+		sealed, err := key.Seal("chunks/name", plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := key.Seal("chunks/name", plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(sealed, again) {
+			t.Fatal("sealing twice gave the same value, the nonce was reused")
+		}
+		if len(plaintext) > 0 && bytes.Contains(sealed, plaintext) {
+			t.Fatal("the plaintext is visible in the sealed value")
+		}
+
+		got, err := key.Open("chunks/name", sealed)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("opened %v bytes of %v: %v", len(got), len(plaintext), err)
+		}
+		if _, err := key.Open("chunks/other", sealed); err != ErrTampered {
+			t.Fatalf("a value moved to another name opened: %v", err)
+		}
+		if _, err := other.Open("chunks/name", sealed); err != ErrTampered {
+			t.Fatalf("another key opened the value: %v", err)
+		}
+		for _, i := range []int{0, 1, 12, 13, len(sealed) - 1} {
+			tampered := append([]byte(nil), sealed...)
+			tampered[i] ^= 1
+			if _, err := key.Open("chunks/name", tampered); err != ErrTampered {
+				t.Fatalf("a value with byte %v changed opened: %v", i, err)
+			}
+		}
+		if _, err := key.Open("chunks/name", sealed[:len(sealed)-1]); err != ErrTampered {
+			t.Fatalf("a cut value opened: %v", err)
+		}
+	}
+	if _, err := key.Open("chunks/name", nil); err != ErrTampered {
+		t.Fatalf("an empty value opened: %v", err)
+	}
+}
+
+//stored names are keyed, as long as the hash they replace and the same for the same key
+func TestHideName(t *testing.T) {
+	key, err := NewRepoKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRepoKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	md5 := "0123456789abcdef0123456789abcdef"
+	hidden := key.HideName(md5)
+	if hidden == md5 || len(hidden) != len(md5) || !isMd5(hidden) {
+		t.Fatalf("%v was hidden as %v", md5, hidden)
+	}
+	if key.HideName(md5) != hidden || other.HideName(md5) == hidden {
+		t.Fatal("the hidden name does not depend on the key alone")
+	}
+	//keys made before names were hidden store under the hash
+	legacy := &RepoKey{Encrypt: key.Encrypt}
+	if legacy.HideName(md5) != md5 {
+		t.Fatal("a key without a MAC key changed the name")
+	}
+}
+
+//an encrypted repo stores neither file contents nor file hashes in the clear
+func TestEncryptedRepo(t *testing.T) {
+	key, err := NewRepoKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	b := newMemBackend()
+	r := NewRepo(b, 0)
+	r.SetKey(key)
+
+	text := bytes.Repeat([]byte("a secret line of text\n"), 100000)
+	name := filepath.Join(dir, "secret.txt")
+	os.WriteFile(name, text, 0644)
+	hash, chunks, _, err := r.SaveFile("", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range b.values {
+		if strings.Contains(k, hash) || bytes.Contains(v, []byte("a secret line")) {
+			t.Fatalf("%v shows the file in the clear", k)
+		}
+		for _, chunk := range chunks {
+			if strings.Contains(k, chunk) {
+				t.Fatalf("%v shows a chunk hash", k)
+			}
+		}
+	}
+
+	opened := NewRepo(b, 0)
+	opened.SetKey(key)
+	checkRestore(t, opened, hash, name)
+
+	wrong, err := NewRepoKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//with another key the file is not even found, with the names of this key its values do not open
+	other := NewRepo(b, 0)
+	other.SetKey(wrong)
+	if err := other.Restore(hash, &bytes.Buffer{}); err == nil {
+		t.Fatal("another key restored the file")
+	}
+	other.SetKey(&RepoKey{Encrypt: wrong.Encrypt, MAC: key.MAC})
+	if err := other.Restore(hash, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), ErrTampered.Error()) {
+		t.Fatalf("another encryption key returned %v", err)
+	}
+}
+
+//the first run creates the key and stores the key file with the backups, a new computer fetches it
+func TestOpenRepoKey(t *testing.T) {
+	dir := t.TempDir()
+	targets := []Target{{Name: "mem", Repo: NewRepo(newMemBackend(), 0)}}
+	cf := &Account{KeyFile: filepath.Join(dir, "key.json")}
+	t.Setenv(PassphraseEnv, "correct horse")
+
+	key, err := OpenRepoKey(cf, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := targets[0].Stat(RemoteKeyFile); err != nil {
+		t.Fatalf("the key file was not stored with the backups: %v", err)
+	}
+	if info, err := os.Stat(cf.KeyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("the local key file is %v: %v", info.Mode(), err)
+	}
+
+	os.Remove(cf.KeyFile)
+	fetched, err := OpenRepoKey(cf, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched.Encrypt, key.Encrypt) {
+		t.Fatal("the fetched key file opened a different key")
+	}
+
+	t.Setenv(PassphraseEnv, "wrong horse")
+	if _, err := OpenRepoKey(cf, targets); err == nil {
+		t.Fatal("a wrong passphrase opened the key")
+	}
+
+	if key, err := OpenRepoKey(&Account{}, targets); key != nil || err != nil {
+		t.Fatalf("no keyfile preference returned %v, %v", key, err)
+	}
+}
+
+//a local key file left behind by a change made on another machine is refused, removing it fetches the stored copy
+func TestStaleKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	targets := []Target{{Name: "mem", Repo: NewRepo(newMemBackend(), 0)}}
+	cf := &Account{KeyFile: filepath.Join(dir, "key.json")}
+	t.Setenv(PassphraseEnv, "correct horse")
+	if _, err := OpenRepoKey(cf, targets); err != nil {
+		t.Fatal(err)
+	}
+
+	//another machine rotates the key and replaces the stored copy
+	other := &Account{KeyFile: filepath.Join(dir, "other.json")}
+	kf, err := LoadKeyFile(other, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := kf.Unwrap("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := RotateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kf, err = WrapKey(next, "passphrase", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveKeyFile(other, targets, kf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenRepoKey(cf, targets); err == nil || !strings.Contains(err.Error(), "differs") {
+		t.Fatalf("a stale key file returned %v", err)
+	}
+	os.Remove(cf.KeyFile)
+	fetched, err := OpenRepoKey(cf, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched.Encrypt, next.Encrypt) {
+		t.Fatal("the fetched key file opened the old key")
+	}
+}
+
+//a version 1 key file, one slot without an id, is read as a single slot
+func TestParseKeyFileVersion1(t *testing.T) {
+	key, err := NewRepoKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kf, err := WrapKey(key, "passphrase", "old passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot := kf.Slots[0]
+	doc, err := json.Marshal(struct {
+		Version int `json:"version"`
+		KeySlot
+	}{1, slot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := ParseKeyFile(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old.Slots) != 1 || old.Slots[0].ID != "1" || old.Version != KeyFileVersion {
+		t.Fatalf("read as %+v", old)
+	}
+	if got, _, err := old.Unwrap("old passphrase"); err != nil || !bytes.Equal(got.Encrypt, key.Encrypt) {
+		t.Fatalf("the version 1 slot did not open: %v", err)
+	}
+	if _, err := ParseKeyFile([]byte(`{"version":9}`)); err == nil {
+		t.Fatal("an unknown version was read")
+	}
+}
+
+//every slot opens the same key, and a slot removed no longer does
+func TestKeySlots(t *testing.T) {
+	key, err := NewRepoKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kf, err := WrapKey(key, "alice", "first passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := kf.AddSlot(key, "bob", "second passphrase", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobID := bob.ID
+	recovery, err := NewRecoveryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kf.AddSlot(key, "recovery", recovery, true); err != nil {
+		t.Fatal(err)
+	}
+
+	//the key file is stored as json and read back before it is used
+	doc, err := json.Marshal(kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kf, err = ParseKeyFile(doc); err != nil {
+		t.Fatal(err)
+	}
+
+	//a recovery key may be typed in lower case and with spaces in place of dashes
+	typed := strings.ToLower(strings.Replace(recovery, "-", " ", -1))
+	for _, passphrase := range []string{"first passphrase", "second passphrase", typed} {
+		got, _, err := kf.Unwrap(passphrase)
+		if err != nil {
+			t.Fatalf("%q: %v", passphrase, err)
+		}
+		if !bytes.Equal(got.Encrypt, key.Encrypt) || !bytes.Equal(got.MAC, key.MAC) {
+			t.Fatalf("%q opened a different key", passphrase)
+		}
+	}
+	if _, _, err := kf.Unwrap("wrong passphrase"); err == nil {
+		t.Fatal("a wrong passphrase opened the key")
+	}
+
+	if err := kf.RemoveSlot(bobID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := kf.Unwrap("second passphrase"); err == nil {
+		t.Fatal("a removed slot still opens the key")
+	}
+	if _, _, err := kf.Unwrap("first passphrase"); err != nil {
+		t.Fatalf("removing a slot broke another: %v", err)
+	}
+
+	for len(kf.Slots) > 1 {
+		if err := kf.RemoveSlot(kf.Slots[0].ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kf.RemoveSlot(kf.Slots[0].ID); err == nil {
+		t.Fatal("the last slot was removed")
+	}
+}
+
+//a rotated key seals with the new key, still opens what the old one sealed and keeps the stored names
+func TestRotateKey(t *testing.T) {
+	key, err := NewRepoKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := key.Seal("name", []byte("old value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := RotateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := next.Open("name", old); err != nil || string(got) != "old value" {
+		t.Fatalf("opening a value of the old key gave %q, %v", got, err)
+	}
+	if next.HideName("abcd") != key.HideName("abcd") {
+		t.Fatal("rotating changed the stored names")
+	}
+
+	sealed, err := next.Seal("name", []byte("new value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.Open("name", sealed); err != ErrTampered {
+		t.Fatalf("the old key opened a value of the new key: %v", err)
+	}
+	next.Old = nil
+	if _, err := next.Open("name", old); err != ErrTampered {
+		t.Fatalf("a value of a dropped key still opens: %v", err)
+	}
+}
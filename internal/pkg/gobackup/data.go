@@ -1,17 +1,11 @@
 package gobackup
 
 import (
-	"bufio"
-	"bytes"
 	"crypto/md5"
-	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
-	"strings"
 	"time"
 )
 
@@ -20,180 +14,54 @@ func hashToString(in []byte) string {
 	return hex.EncodeToString(in)
 }
 
-//run md5 hash on a string
-func md5string(a string) string {
-	data := md5.Sum([]byte(a))
-	return hashToString(data[:])
+//the largest value stored under a single key, Workers KV rejects values over 25 MiB
+//files are stored as chunks of at most MaxChunkSize
+const MaxValueSize = 25 * 1000 * 1000
+
+//does s look like a hex md5 hash
+func isMd5(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
 }
 
 //run md5 hash on a file
+//the file is streamed through the hash, so memory use does not grow with the file
 func Md5file(in string) string {
-	dat, err := ioutil.ReadFile(in)
+	file, err := os.Open(in)
 	if err != nil {
 		log.Fatalf("md5 failed")
 	}
-	data := md5.Sum(dat)
-	return hashToString(data[:])
-}
-
-//write data in a stream-like fashion
-func BuildData2(a *Data1) ([]byte, error) {
-	var result bytes.Buffer
-
-	for i := 0; i < len(a.TheMetadata); i++ {
-		aMetadata := a.TheMetadata[i]
-		part, err := json.Marshal(aMetadata)
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		result.WriteString(string(part))
-	}
-	return result.Bytes(), nil
-}
-
-//write data to disk for a maximum of 100 MB
-func BuildData(a *Data1) string {
-	var sb strings.Builder
-
-	//start the array
-	sb.WriteString("[")
-
-	//if files are less than 100MB or less than 10000
-	buf := bytes.Buffer{}
-
-	//for loop
-	for i := 0; i < (len(a.TheMetadata) - 1); i++ {
-		d := a.TheMetadata[i]
-
-		file, err := os.Open(string(d.FileName))
-		if err != nil {
-			log.Fatalf("searchData failed opening file:" + string(d.FileName))
-		}
-		defer file.Close()
-
-		body, err := ioutil.ReadAll(file)
-		if err != nil {
-			log.Fatalln(err)
-		}
-
-		sb.WriteString("{\"key\":\"")
-		sb.WriteString(d.Hash)
-		sb.WriteString("\",\"value\":\"")
-		json.HTMLEscape(&buf, body)
-		sb.Write(buf.Bytes()) //compress and encrypt?
-		sb.WriteString("\",\"expiration_ttl\":")
-		sb.WriteString("60000")
-		sb.WriteString(",\"Metadata\":{\"")
-		sb.WriteString("The Metadata Key")
-		sb.WriteString("\":\"")
-		sb.WriteString(GetMetadata(d))
-		sb.WriteString("\"},\"base64\":false},")
-	}
-
-	d := a.TheMetadata[len(a.TheMetadata)-1]
-
-	file, err := os.Open(string(d.FileName))
-	if err != nil {
-		log.Fatalf("searchData failed opening file:" + string(d.FileName))
-	}
 	defer file.Close()
 
-	body, err := ioutil.ReadAll(file)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	sb.WriteString("{\"key\":\"")
-	sb.WriteString(d.Hash)
-	sb.WriteString("\",\"value\":\"")
-	escaped := strings.ReplaceAll(string(body), `"`, `\"`)
-	escaped = strings.ReplaceAll(escaped, `\`, `\\`)
-	escaped = strings.ReplaceAll(escaped, "`", "\\`")
-	sb.WriteString(escaped)
-	sb.WriteString("\",\"expiration_ttl\":")
-	sb.WriteString("6000")
-	sb.WriteString(",\"Metadata\":{\"")
-	sb.WriteString("The Metadata Key")
-	sb.WriteString("\":\"")
-	sb.WriteString(GetMetadata(d))
-	sb.WriteString("\"},\"base64\":false}")
-
-	//end the array
-	sb.WriteString("]")
-
-	fmt.Println("SB =" + sb.String())
-	return sb.String()
-}
-
-//create a data file from data struct
-func DataFile2(file string, dat *Data1) {
-
-	theFile, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE, 0644)
-	if err != nil {
-		log.Fatalf("problem opening file '%s': %v", file, err)
-	}
-
-	defer theFile.Close()
-
-	datawriter := bufio.NewWriter(theFile)
-	for i, data := range dat.TheMetadata {
-		//added a spacer between the hash and filename
-		_, _ = datawriter.WriteString(dat.TheMetadata[i].Hash + ":" + GetMetadata(data) + "\n")
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		log.Fatalf("md5 failed")
 	}
-	datawriter.Flush()
-
+	return hashToString(hash.Sum(nil))
 }
 
-//extracts the Metadata from a file
-func CreateMeta(file string) Metadata {
+//the Metadata of a file from its directory entry, without reading it, Hash is left blank
+func FileMeta(file string) (Metadata, error) {
 	fi, err := os.Lstat(file)
 	if err != nil {
-		log.Fatalln(err)
+		return Metadata{}, err
 	}
-
-	var temp Metadata
-
-	fmt.Printf("permissions: %#o\n", fi.Mode().Perm()) // 0400, 0777, etc.
-
-	temp.FileName = Stream(file)
-	temp.Hash = Md5file(file)
-	temp.FileNum = "f1o1"
-	temp.Atime = fi.ModTime()
-	temp.Permissions = fi.Mode().Perm().String()
-	temp.Size = fi.Size()
-	return temp
+	return Metadata{
+		FileName:    Stream(file),
+		Atime:       fi.ModTime(),
+		Permissions: fi.Mode().Perm().String(),
+		Size:        fi.Size(),
+	}, nil
 }
 
 func GetMetadata(d Metadata) string {
-	return string(d.FileName) + ":" + d.FileNum + ":" + d.Notes + ":" + d.Atime.String()
-}
-
-func (a Stream) MarshalJSON() ([]byte, error) {
-	//start of marshal
-	fmt.Println("Marshal is working!")
-	//convert from Stream type to string
-	filename := string(a)
-
-	file, err := os.Open(filename)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	fileContents, err := ioutil.ReadAll(file)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	//escape html
-	base64 := base64.StdEncoding.EncodeToString(fileContents)
-	base64 = "\"" + base64 + "\""
-
-	//dest, source
-	fmt.Printf("Length:%v", len(base64))
-	return []byte(base64), nil
+	return string(d.FileName) + ":" + d.Notes + ":" + d.Atime.String()
 }
 
+//the name of a file
 type Stream string
 
 //this struct stores the Metadata that will be uploaded with each file
@@ -210,6 +78,9 @@ type Metadata struct {
 	FileName                                    Stream
 	Atime                                       time.Time
 	Size                                        int64
+	Chunks                                      []string //sha256 hashes of the file's chunks, in order
+	Targets                                     []string //names of the backends holding the object
+	Codec                                       string   //compression the file was stored with: none, gzip or zstd
 }
 
 // ByHash Implements sort.Interface for []Metadata based on the Hash field.
@@ -228,6 +99,7 @@ func (h ByHash) Less(i, j int) bool {
 }
 
 //******* This struct contains the data tracking uploads*****
+//it was written to data.dat as TOML and is now only read when importing into the catalog, see Catalog.ImportDataFile
 //Redo: Datasize will be size of files
 //      remove hash, use only Metadata => add hash to Metadata
 //
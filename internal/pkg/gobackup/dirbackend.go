@@ -0,0 +1,153 @@
+package gobackup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//Dir stores objects as files below a local directory, such as a mounted NAS or USB disk
+//a key is stored at Root/<first two characters of key>/<key> so no single directory grows too large
+type Dir struct {
+	Root string
+}
+
+//create a directory backend rooted at root, creating root if needed
+func NewDir(root string) (*Dir, error) {
+	if root == "" {
+		return nil, fmt.Errorf("the dir backend needs a path")
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &Dir{Root: root}, nil
+}
+
+//the location of key on disk
+func (d *Dir) path(key string) (string, error) {
+	if len(key) < 2 || strings.HasPrefix(key, "/") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return filepath.Join(d.Root, key[:2], filepath.FromSlash(key)), nil
+}
+
+//write r to a temporary file next to the destination and rename it into place
+//a crash part way through never leaves a truncated object under key
+func (d *Dir) Put(key string, r io.Reader) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(temp, r)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+//copy the file stored under key into w
+func (d *Dir) Get(key string, w io.Writer) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+//walk the tree and return every key starting with prefix
+func (d *Dir) List(prefix string) ([]string, error) {
+	var keys []string
+
+	err := filepath.Walk(d.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.Root, path)
+		if err != nil {
+			return err
+		}
+
+		//drop the two character fan out directory
+		parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		if strings.HasPrefix(parts[1], prefix) {
+			keys = append(keys, parts[1])
+		}
+		return nil
+	})
+	return keys, err
+}
+
+//remove the file stored under key
+func (d *Dir) Delete(key string) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//get the size of the file stored under key
+func (d *Dir) Stat(key string) (ObjectInfo, error) {
+	name, err := d.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: fi.Size()}, nil
+}
@@ -0,0 +1,99 @@
+package gobackup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//a reader that fails after handing out some data
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("read failed")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDirBackend(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "nas", "backup")
+	d, err := NewDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, d)
+
+	//keys are fanned out by their first two characters
+	if _, err := os.Stat(filepath.Join(root, "ch", "chunks", "ab")); err != nil {
+		t.Fatal(err)
+	}
+
+	//an upload cut short leaves neither the key nor its temporary file behind
+	if err := d.Put("chunks/cut", &failingReader{data: []byte("partial")}); err == nil {
+		t.Fatal("a failed read was stored")
+	}
+	if _, err := d.Stat("chunks/cut"); err != ErrNotFound {
+		t.Fatalf("stat of a failed upload returned %v", err)
+	}
+	temps, _ := filepath.Glob(filepath.Join(root, "ch", "chunks", ".tmp-*"))
+	if len(temps) != 0 {
+		t.Fatalf("temporary files were left: %v", temps)
+	}
+
+	//a temporary file left by a crash is not listed
+	os.WriteFile(filepath.Join(root, "ch", "chunks", ".tmp-123"), []byte("crash"), 0644)
+	keys, err := d.List("chunks/")
+	if err != nil || strings.Join(keys, ",") != "chunks/ab" {
+		t.Fatalf("list returned %v: %v", keys, err)
+	}
+
+	for _, key := range []string{"", "a", "/etc/passwd", "chunks/../../x", "chunks//x", "./x"} {
+		if err := d.Put(key, bytes.NewReader(nil)); err == nil {
+			t.Fatalf("%q was accepted as a key", key)
+		}
+	}
+	if _, err := NewDir(""); err == nil {
+		t.Fatal("a dir backend without a path was created")
+	}
+}
+
+//files saved to a directory are restored by a repo opened on it later
+func TestDirRepo(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDir(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepo(d, 0)
+	var names []string
+	for i, size := range []int{10, 5000, 2*MinChunkSize + 17} {
+		name := writeRandomFile(t, dir, "file"+string(rune('a'+i)), int64(i), size)
+		if _, _, _, err := r.SaveFile("", name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if lost := r.Flush(); len(lost) != 0 {
+		t.Fatalf("lost %v", lost)
+	}
+
+	again, err := NewDir(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		checkRestore(t, NewRepo(again, 0), Md5file(name), name)
+	}
+	if err := NewRepo(again, 0).Restore("0123456789abcdef0123456789abcdef", io.Discard); err != ErrNotFound {
+		t.Fatalf("restoring a missing file returned %v", err)
+	}
+}
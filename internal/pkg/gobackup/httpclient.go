@@ -0,0 +1,197 @@
+package gobackup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//how often and how long a failed request is retried
+const (
+	httpRetries   = 6
+	httpBaseDelay = 500 * time.Millisecond
+	httpMaxDelay  = time.Minute
+)
+
+//returned once a backend refused the credentials, requests are no longer sent after that
+var ErrAuth = errors.New("gobackup: the backend refused the credentials")
+
+//httpClient sends the requests of the HTTP backends
+//requests that may succeed later are retried, see send, and a refused login stops every later request
+type httpClient struct {
+	client *http.Client
+	//the error message in the body of a failed response, nil uses the body as it is
+	describe func(body []byte) string
+
+	mu      sync.Mutex
+	authErr error //set by the first 401 or 403
+}
+
+func newHTTPClient(describe func(body []byte) string) *httpClient {
+	return &httpClient{client: &http.Client{}, describe: describe}
+}
+
+//should a response with this status be retried
+//429 is rate limiting, 5xx is the server or a proxy in front of it having trouble
+func retryStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+//the wait before retry number attempt, doubling each time with jitter so parallel workers spread out
+//a Retry-After header from resp is used instead when it is present
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if after := resp.Header.Get("Retry-After"); after != "" {
+			if secs, err := strconv.Atoi(after); err == nil {
+				return clampDelay(time.Duration(secs) * time.Second)
+			}
+			if at, err := http.ParseTime(after); err == nil {
+				return clampDelay(time.Until(at))
+			}
+		}
+	}
+	delay := clampDelay(httpBaseDelay << uint(attempt))
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func clampDelay(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	if d > httpMaxDelay {
+		return httpMaxDelay
+	}
+	return d
+}
+
+//send req, retrying transport errors, 429 and 5xx responses with backoff
+//a request whose body cannot be read again is only sent once
+//returns the last response whatever its status, the caller must close its body
+func (c *httpClient) send(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	authErr := c.authErr
+	c.mu.Unlock()
+	if authErr != nil {
+		return nil, authErr
+	}
+
+	replayable := req.Body == nil || req.GetBody != nil
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := c.client.Do(req)
+		last := attempt == httpRetries || !replayable
+		switch {
+		case err != nil:
+			if last || req.Context().Err() != nil {
+				return nil, err
+			}
+		case retryStatus(resp.StatusCode) && !last:
+			resp.Body.Close()
+		default:
+			if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				err := fmt.Errorf("%v: %v %v: %v %v", ErrAuth, req.Method, req.URL.Path, resp.Status, c.message(body))
+				c.mu.Lock()
+				c.authErr = err
+				c.mu.Unlock()
+				return nil, err
+			}
+			return resp, nil
+		}
+
+		delay := retryDelay(attempt, resp)
+		fmt.Printf("%v %v: %v, retrying in %v\n", req.Method, req.URL.Path, retryReason(resp, err), delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+//why a request is being retried
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+//the error message of a failed response body
+func (c *httpClient) message(body []byte) string {
+	if c.describe != nil {
+		if msg := c.describe(body); msg != "" {
+			return msg
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
+//send the request and turn a non 2xx status into an error, 404 becomes ErrNotFound
+//the caller must close the body of the returned response
+func (c *httpClient) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v %v: %v %v", req.Method, req.URL.Path, resp.Status, c.message(body))
+	}
+	return resp, nil
+}
+
+//the envelope the cloudflare api wraps its answers in
+//{"success":true,"errors":[],"messages":[],"result":...}
+type cfEnvelope struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+//the errors listed in a cloudflare envelope, blank when body is not one or lists none
+func cfErrors(body []byte) string {
+	var env cfEnvelope
+	if json.Unmarshal(body, &env) != nil || len(env.Errors) == 0 {
+		return ""
+	}
+	msgs := make([]string, len(env.Errors))
+	for i, e := range env.Errors {
+		msgs[i] = fmt.Sprintf("%v (code %v)", e.Message, e.Code)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+//check the envelope of a successful cloudflare response
+//the api can answer 200 and still report that the request failed
+func cfCheck(body []byte) error {
+	var env cfEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return fmt.Errorf("cloudflare: unexpected response: %v", err)
+	}
+	if !env.Success {
+		if msg := cfErrors(body); msg != "" {
+			return fmt.Errorf("cloudflare: %v", msg)
+		}
+		return errors.New("cloudflare: the request failed")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package gobackup
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//a server answering each request with the next status of statuses, the last one once they run out
+//Retry-After is 0 so the retries do not wait, the bodies received are returned
+func newStatusServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int64, *[]string) {
+	requests := &atomic.Int64{}
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := int(requests.Add(1))
+		body, _ := io.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		status := statuses[len(statuses)-1]
+		if n <= len(statuses) {
+			status = statuses[n-1]
+		}
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(status)
+		io.WriteString(w, http.StatusText(status))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests, &bodies
+}
+
+//429 and 5xx are retried with the body sent again, until one succeeds
+func TestHTTPRetry(t *testing.T) {
+	server, requests, bodies := newStatusServer(t, 429, 503, 502, 200)
+	c := newHTTPClient(nil)
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/key", bytes.NewReader([]byte("value")))
+	resp, err := c.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if requests.Load() != 4 {
+		t.Fatalf("sent %v requests, want 4", requests.Load())
+	}
+	for _, body := range *bodies {
+		if body != "value" {
+			t.Fatalf("a retry sent %q", body)
+		}
+	}
+}
+
+//a server that keeps failing is given up on after httpRetries retries, with its last answer
+func TestHTTPRetryLimit(t *testing.T) {
+	server, requests, _ := newStatusServer(t, 500)
+	c := newHTTPClient(nil)
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/key", nil)
+	_, err := c.do(req)
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("a failing server returned %v", err)
+	}
+	if requests.Load() != httpRetries+1 {
+		t.Fatalf("sent %v requests, want %v", requests.Load(), httpRetries+1)
+	}
+}
+
+//refused credentials are not retried, and no request is sent after them
+func TestHTTPAuth(t *testing.T) {
+	server, requests, _ := newStatusServer(t, 401)
+	c := newHTTPClient(nil)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/key", nil)
+		if _, err := c.do(req); err == nil || !strings.Contains(err.Error(), ErrAuth.Error()) {
+			t.Fatalf("a refused login returned %v", err)
+		}
+	}
+	if requests.Load() != 1 {
+		t.Fatalf("sent %v requests after a 401, want 1", requests.Load())
+	}
+}
+
+//Retry-After is waited for as asked, within httpMaxDelay, otherwise the wait doubles with jitter
+func TestRetryDelay(t *testing.T) {
+	after := func(value string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": {value}}}
+	}
+	if d := retryDelay(0, after("7")); d != 7*time.Second {
+		t.Errorf("Retry-After: 7 waited %v", d)
+	}
+	if d := retryDelay(0, after("3600")); d != httpMaxDelay {
+		t.Errorf("Retry-After: 3600 waited %v", d)
+	}
+	at := time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)
+	if d := retryDelay(0, after(at)); d < 8*time.Second || d > 10*time.Second {
+		t.Errorf("Retry-After: %v waited %v", at, d)
+	}
+	for attempt := 0; attempt < 4; attempt++ {
+		full := httpBaseDelay << uint(attempt)
+		if d := retryDelay(attempt, nil); d < full/2 || d > full {
+			t.Errorf("retry %v waited %v, want %v to %v", attempt, d, full/2, full)
+		}
+	}
+	if d := retryDelay(20, nil); d > httpMaxDelay {
+		t.Errorf("retry 20 waited %v", d)
+	}
+}
@@ -0,0 +1,149 @@
+package gobackup
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+//the journal is kept next to the catalog while a backup runs, named after it with this suffix
+const JournalSuffix = "-journal"
+
+//the name of the journal of the catalog called catalog, e.g. catalog.db-journal
+func JournalFile(catalog string) string {
+	return catalog + JournalSuffix
+}
+
+//a line of the journal, a target holding a file
+//the path, size and time let the next run know the file without reading it, like the catalog
+type JournalEntry struct {
+	Target  string    `json:"target"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+	Hash    string    `json:"hash"`
+	Chunks  []string  `json:"chunks,omitempty"`
+	Codec   string    `json:"codec,omitempty"`
+}
+
+//Journal records each file as soon as a target holds all of it
+//the catalog is only updated at the end of a run, the journal lets a run that was cut short skip what already reached the targets
+//it is removed once the catalog is updated
+type Journal struct {
+	name string
+
+	mu      sync.Mutex
+	file    *os.File
+	held    map[string][]JournalEntry //entries left by an interrupted run, by path
+	stored  map[string][]Metadata     //files handed to the targets this run, by hash, one for each path holding the content
+	waiting map[string][]string       //committed files whose Metadata has not been added yet, by target
+}
+
+//open the journal called name, reading the entries an interrupted run left in it
+//new entries are appended, so a run that is cut short again loses nothing
+func OpenJournal(name string) (*Journal, error) {
+	j := &Journal{name: name, held: map[string][]JournalEntry{}, stored: map[string][]Metadata{}, waiting: map[string][]string{}}
+
+	old, err := os.Open(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scan := bufio.NewScanner(old)
+		for scan.Scan() {
+			var e JournalEntry
+			//the last line is cut short when the run died while writing it
+			if json.Unmarshal(scan.Bytes(), &e) != nil || e.Target == "" || e.Path == "" || e.Hash == "" {
+				continue
+			}
+			j.held[e.Path] = append(j.held[e.Path], e)
+		}
+		old.Close()
+		if err := scan.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if j.file, err = os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+//add the targets that held meta's file when an earlier run was cut short to meta.Targets
+//the file is matched by its path, size and modification time, and by its hash unless meta.Hash is blank
+//returns the targets added, meta.Hash, meta.Chunks and meta.Codec are filled in from the journal when any are
+func (j *Journal) Resume(meta *Metadata) []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var added []string
+	for _, e := range j.held[string(meta.FileName)] {
+		if e.Size != meta.Size || !e.ModTime.Equal(meta.Atime) || (meta.Hash != "" && e.Hash != meta.Hash) {
+			continue
+		}
+		if HasTarget(*meta, e.Target) {
+			continue
+		}
+		meta.Targets = append(meta.Targets, e.Target)
+		meta.Hash, meta.Chunks, meta.Codec = e.Hash, e.Chunks, e.Codec
+		added = append(added, e.Target)
+	}
+	return added
+}
+
+//remember how the file described by meta was stored, after Replicate
+//its entries are written by Commit once the targets report the file as stored
+func (j *Journal) Add(meta Metadata) {
+	if meta.Hash == "" {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stored[meta.Hash] = append(j.stored[meta.Hash], meta)
+}
+
+//write an entry for every file the targets finished storing since the last call, see Repo.Committed
+//the entries are synced to disk before returning
+func (j *Journal) Commit(targets []Target) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	w := bufio.NewWriter(j.file)
+	for _, t := range targets {
+		//a file can be committed by another worker's flush before its own worker added it
+		keys := append(j.waiting[t.Name], t.Committed()...)
+		j.waiting[t.Name] = nil
+
+		for _, key := range keys {
+			metas, ok := j.stored[key]
+			if !ok {
+				j.waiting[t.Name] = append(j.waiting[t.Name], key)
+				continue
+			}
+			for _, meta := range metas {
+				line, err := json.Marshal(JournalEntry{Target: t.Name, Path: string(meta.FileName), Size: meta.Size, ModTime: meta.Atime,
+					Hash: key, Chunks: meta.Chunks, Codec: meta.Codec})
+				if err != nil {
+					return err
+				}
+				w.Write(line)
+				w.WriteString("\n")
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+//close the journal and delete it, once everything it recorded is in the catalog
+func (j *Journal) Remove() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(j.name)
+}
@@ -0,0 +1,82 @@
+package gobackup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//a file is hashed while it is uploaded, and a run cut short afterwards finds it in the journal by path, size and time
+func TestJournalResume(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		writeRandomFile(t, dir, "small", 1, 1000),
+		writeRandomFile(t, dir, "large", 2, 3*MinChunkSize),
+	}
+	targets := []Target{{Name: "mem", Repo: NewRepo(newMemBackend(), 0)}}
+
+	journalName := JournalFile(filepath.Join(dir, "catalog.db"))
+	j, err := OpenJournal(journalName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		meta, err := FileMeta(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := Replicate(targets, &meta); len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		if meta.Hash != Md5file(name) {
+			t.Fatalf("%v was stored under %v, its md5 is %v", name, meta.Hash, Md5file(name))
+		}
+		j.Add(meta)
+	}
+	if lost := targets[0].Flush(); len(lost) != 0 {
+		t.Fatalf("lost %v", lost)
+	}
+	for _, name := range names {
+		checkRestore(t, targets[0].Repo, Md5file(name), name)
+	}
+	if err := j.Commit(targets); err != nil {
+		t.Fatal(err)
+	}
+
+	//the next run has not read the files, it only knows what Lstat tells it
+	resumed, err := OpenJournal(journalName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		meta, err := FileMeta(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added := resumed.Resume(&meta)
+		if len(added) != 1 || added[0] != "mem" || meta.Hash != Md5file(name) {
+			t.Fatalf("%v resumed with targets %v and hash %v", name, added, meta.Hash)
+		}
+	}
+
+	//a file changed since it was journaled is uploaded again
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(names[0], later, later); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := FileMeta(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added := resumed.Resume(&meta); len(added) != 0 || meta.Hash != "" {
+		t.Fatalf("a changed file resumed with targets %v and hash %v", added, meta.Hash)
+	}
+
+	if err := j.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journalName); !os.IsNotExist(err) {
+		t.Fatalf("the journal is still there: %v", err)
+	}
+}
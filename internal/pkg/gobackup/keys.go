@@ -0,0 +1,421 @@
+package gobackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+//where every target keeps a copy of the key file
+//the copy lets a new machine restore with only the passphrase
+const RemoteKeyFile = "keys/repo"
+
+//the environment variable checked first for the passphrase, handy for cron jobs
+const PassphraseEnv = "GOBACKUP_PASSWORD"
+
+//get the passphrase for the repository key
+//GOBACKUP_PASSWORD is used first, then the file named by the PasswordFile preference, then the terminal is asked
+//confirm asks twice on the terminal, for a passphrase that is about to be set
+func Passphrase(cf *Account, confirm bool) (string, error) {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return p, nil
+	}
+	if cf.PasswordFile != "" {
+		data, err := ioutil.ReadFile(cf.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return readPassphrase("Passphrase: ", confirm)
+}
+
+//the environment variable checked for a passphrase being added to the key file
+const NewPassphraseEnv = "GOBACKUP_NEW_PASSWORD"
+
+//get a passphrase to add to the key file
+//GOBACKUP_NEW_PASSWORD is used first, otherwise the terminal is asked twice
+func NewPassphrase() (string, error) {
+	if p := os.Getenv(NewPassphraseEnv); p != "" {
+		return p, nil
+	}
+	return readPassphrase("New passphrase: ", true)
+}
+
+//ask for a passphrase on the terminal without echoing it
+func readPassphrase(prompt string, confirm bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("a passphrase is needed, set %v or the passwordfile preference", PassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(p) == 0 {
+		return "", errors.New("the passphrase cannot be empty")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(p, again) {
+			return "", errors.New("the passphrases do not match")
+		}
+	}
+	return string(p), nil
+}
+
+//read a key file from disk
+func ReadKeyFile(name string) (*KeyFile, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	kf, err := ParseKeyFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	return kf, nil
+}
+
+//write a key file to disk, readable only by the owner
+func WriteKeyFile(name string, kf *KeyFile) error {
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, data, 0600)
+}
+
+//get the copy of the key file target t holds, ErrNotFound when it has none
+func remoteKeyFile(t Target) (*KeyFile, error) {
+	var data bytes.Buffer
+	err := t.Get(RemoteKeyFile, &data)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", t.Name, err)
+	}
+
+	kf, err := ParseKeyFile(data.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v: %v", t.Name, RemoteKeyFile, err)
+	}
+	return kf, nil
+}
+
+//get the key file from the first target that has a copy
+func fetchKeyFile(targets []Target) (*KeyFile, error) {
+	for _, t := range targets {
+		kf, err := remoteKeyFile(t)
+		if err == ErrNotFound {
+			continue
+		}
+		return kf, err
+	}
+	return nil, ErrNotFound
+}
+
+//check that every target holding a copy of the key file holds the same one as kf
+//a key rotated on another machine leaves the local file stale, values it sealed could not be read with the new key
+func checkKeyFile(cf *Account, targets []Target, kf *KeyFile) error {
+	local, err := json.Marshal(kf)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		remote, err := remoteKeyFile(t)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		doc, err := json.Marshal(remote)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(doc, local) {
+			return fmt.Errorf("%v differs from the key file stored on %v, the key was changed on another machine or the change did not reach every target, "+
+				"remove %v to use the stored copy", cf.KeyFile, t.Name, cf.KeyFile)
+		}
+	}
+	return nil
+}
+
+//copy the key file to the targets, replacing their copies when replace is set and otherwise only where it is missing
+func storeKeyFile(targets []Target, kf *KeyFile, replace bool) error {
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		err := ErrNotFound
+		if !replace {
+			_, err = t.Stat(RemoteKeyFile)
+		}
+		if err == ErrNotFound {
+			err = t.Put(RemoteKeyFile, bytes.NewReader(data))
+		}
+		if err != nil {
+			return fmt.Errorf("%v: storing the key file: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+//load the key file named by the KeyFile preference
+//a missing local key file is fetched from the first target that holds one and saved locally
+//a local key file that differs from a target's copy is an error, see checkKeyFile
+//returns ErrNotFound when neither has one
+func LoadKeyFile(cf *Account, targets []Target) (*KeyFile, error) {
+	if cf.KeyFile == "" {
+		return nil, errors.New("the keyfile preference is not set")
+	}
+
+	kf, err := ReadKeyFile(cf.KeyFile)
+	if os.IsNotExist(err) {
+		kf, err = fetchKeyFile(targets)
+		if err == nil {
+			fmt.Println("Using the key file stored with the backups")
+			err = WriteKeyFile(cf.KeyFile, kf)
+		}
+		return kf, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeyFile(cf, targets, kf); err != nil {
+		return nil, err
+	}
+	return kf, nil
+}
+
+//save a changed key file locally and replace the copy on every target
+func SaveKeyFile(cf *Account, targets []Target, kf *KeyFile) error {
+	if err := WriteKeyFile(cf.KeyFile, kf); err != nil {
+		return err
+	}
+	return storeKeyFile(targets, kf, true)
+}
+
+//ask for the passphrase and open kf with it
+//returns the repository key and the slot that opened
+func UnlockKeyFile(cf *Account, kf *KeyFile) (*RepoKey, *KeySlot, error) {
+	passphrase, err := Passphrase(cf, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return kf.Unwrap(passphrase)
+}
+
+//create a new repository key and its key file with a single slot opened by passphrase
+//the key file is saved locally and on every target
+func InitRepoKey(cf *Account, targets []Target, passphrase string) (*RepoKey, *KeyFile, error) {
+	key, err := NewRepoKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	kf, err := WrapKey(key, "passphrase", passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, kf, SaveKeyFile(cf, targets, kf)
+}
+
+//open the encryption selected in the preferences
+//Recipients selects public key encryption with age, otherwise KeyFile selects a repository key opened with a passphrase
+//returns nil when neither is set and backups are not encrypted
+func OpenCipher(cf *Account, targets []Target) (Cipher, error) {
+	if cf.Recipients != "" {
+		return OpenAgeKey(cf, targets)
+	}
+	key, err := OpenRepoKey(cf, targets)
+	if key == nil {
+		return nil, err
+	}
+	return key, err
+}
+
+//load the repository key named by the KeyFile preference and unwrap it with the passphrase
+//when neither the local file nor any target has a key a new one is created, so the first run of an encrypted backup sets it up
+//returns nil when the KeyFile preference is blank and backups are not encrypted
+func OpenRepoKey(cf *Account, targets []Target) (*RepoKey, error) {
+	if cf.KeyFile == "" {
+		return nil, nil
+	}
+
+	kf, err := LoadKeyFile(cf, targets)
+	if err == ErrNotFound {
+		fmt.Println("Creating a new repository key in " + cf.KeyFile)
+		passphrase, err := Passphrase(cf, true)
+		if err != nil {
+			return nil, err
+		}
+		key, _, err := InitRepoKey(cf, targets, passphrase)
+		return key, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, err := UnlockKeyFile(cf, kf)
+	if err != nil {
+		return nil, err
+	}
+	return key, storeKeyFile(targets, kf, false)
+}
+
+//make a new encryption key to replace key
+//the old encryption keys are kept inside the new key so values they sealed can still be read, see Reencrypt
+//the MAC key is kept, the stored keys it hides cannot be renamed without knowing the hashes behind them
+func RotateKey(key *RepoKey) (*RepoKey, error) {
+	next, err := NewRepoKey()
+	if err != nil {
+		return nil, err
+	}
+	next.MAC = key.MAC
+	next.Old = append([]RepoKey{{Encrypt: key.Encrypt}}, key.Old...)
+	return next, nil
+}
+
+//decrypt every value on the backend and seal it again with the current encryption key
+//after it has run on every target the old keys can be dropped from the repository key
+//returns how many values were sealed again, values that cannot be opened are reported and left as they are
+func (r *Repo) Reencrypt() (int, error) {
+	if r.key == nil {
+		return 0, errors.New("the repository is not encrypted")
+	}
+
+	keys, err := r.List("")
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.index = nil
+	r.lastPack, r.lastPackData = "", nil
+
+	//packs hold separately sealed files and are stored under the hash of their data, so they are rebuilt with their index
+	packs := map[string]bool{}
+	for _, k := range keys {
+		if strings.HasPrefix(k, packIndexPrefix) {
+			packs[strings.TrimPrefix(k, packIndexPrefix)] = true
+		}
+	}
+
+	count := 0
+	for _, k := range keys {
+		if strings.HasPrefix(k, RemoteKeyFile) || packs[k] {
+			continue
+		}
+		if strings.HasPrefix(k, packIndexPrefix) {
+			n, err := r.reencryptPack(strings.TrimPrefix(k, packIndexPrefix))
+			if err != nil {
+				return count, err
+			}
+			count += n
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := r.Get(k, &buf); err != nil {
+			return count, err
+		}
+		plain, err := r.key.Open(k, buf.Bytes())
+		if err == ErrTampered {
+			fmt.Printf("%v: cannot be opened with the repository key, left as it is\n", k)
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		sealed, err := r.key.Seal(k, plain)
+		if err != nil {
+			return count, err
+		}
+		if err := r.Put(k, bytes.NewReader(sealed)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+//seal every file in a pack again, storing the rebuilt pack and its index before removing the old ones
+//the caller must hold r.mu
+func (r *Repo) reencryptPack(pack string) (int, error) {
+	var buf bytes.Buffer
+	if err := r.Get(packIndexPrefix+pack, &buf); err != nil {
+		return 0, err
+	}
+	doc, err := r.key.Open(packIndexPrefix+pack, buf.Bytes())
+	if err != nil {
+		return 0, fmt.Errorf("%v%v: %v", packIndexPrefix, pack, err)
+	}
+	var index PackIndex
+	if err := json.Unmarshal(doc, &index); err != nil {
+		return 0, fmt.Errorf("%v%v: %v", packIndexPrefix, pack, err)
+	}
+
+	buf.Reset()
+	if err := r.Get(pack, &buf); err != nil {
+		return 0, err
+	}
+	old := buf.Bytes()
+
+	var data bytes.Buffer
+	files := make([]PackEntry, 0, len(index.Files))
+	for _, f := range index.Files {
+		if f.Offset+f.Length > int64(len(old)) {
+			return 0, fmt.Errorf("pack %v is shorter than its index", pack)
+		}
+		plain, err := r.key.Open(f.Hash, old[f.Offset:f.Offset+f.Length])
+		if err != nil {
+			return 0, fmt.Errorf("pack %v: %v: %v", pack, f.Hash, err)
+		}
+		sealed, err := r.key.Seal(f.Hash, plain)
+		if err != nil {
+			return 0, err
+		}
+		files = append(files, PackEntry{Hash: f.Hash, Offset: int64(data.Len()), Length: int64(len(sealed)), Codec: f.Codec})
+		data.Write(sealed)
+	}
+
+	next := PackIndex{Pack: chunkHash(data.Bytes()), Files: files}
+	if doc, err = json.Marshal(next); err != nil {
+		return 0, err
+	}
+	if doc, err = r.key.Seal(packIndexPrefix+next.Pack, doc); err != nil {
+		return 0, err
+	}
+	if err := r.Put(next.Pack, bytes.NewReader(data.Bytes())); err != nil {
+		return 0, err
+	}
+	if err := r.Put(packIndexPrefix+next.Pack, bytes.NewReader(doc)); err != nil {
+		return 0, err
+	}
+	if err := r.Delete(packIndexPrefix + pack); err != nil {
+		return 0, err
+	}
+	if err := r.Delete(pack); err != nil {
+		return 0, err
+	}
+	return len(files) + 2, nil
+}
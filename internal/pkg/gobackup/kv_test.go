@@ -0,0 +1,209 @@
+package gobackup
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//fakeKV answers the Workers KV endpoints the KV backend uses, from a map
+//keys are listed two to a page so the cursor is followed
+type fakeKV struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+//a KV backend talking to a new fakeKV
+func newFakeKV(t *testing.T) (*KV, *fakeKV) {
+	f := &fakeKV{values: map[string][]byte{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	kv := NewKV(&Account{Account: "acct", Namespace: "ns", Token: "token"})
+	kv.api = server.URL
+	return kv, f
+}
+
+func (f *fakeKV) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	const base = "/accounts/acct/storage/kv/namespaces/ns/"
+	path := req.URL.EscapedPath()
+	if !strings.HasPrefix(path, base) || req.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	path = strings.TrimPrefix(path, base)
+	kind, escaped, _ := strings.Cut(path, "/")
+	key, _ := url.PathUnescape(escaped)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, found := f.values[key]
+	envelope := func(result string) {
+		fmt.Fprintf(w, `{"success":true,"errors":[],"messages":[],"result":%v}`, result)
+	}
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"success":false,"errors":[{"code":10009,"message":"get: 'key not found'"}],"messages":[],"result":null}`)
+	}
+
+	switch {
+	case kind == "values" && req.Method == http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		f.values[key] = data
+		envelope("null")
+	case kind == "values" && req.Method == http.MethodGet:
+		if !found {
+			notFound()
+			return
+		}
+		w.Write(value)
+	case kind == "values" && req.Method == http.MethodDelete:
+		delete(f.values, key)
+		envelope("null")
+	case kind == "metadata" && req.Method == http.MethodGet:
+		if !found {
+			notFound()
+			return
+		}
+		envelope("null")
+	case kind == "keys" && req.Method == http.MethodGet:
+		var keys []string
+		for k := range f.values {
+			if strings.HasPrefix(k, req.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		start, _ := strconv.Atoi(req.URL.Query().Get("cursor"))
+		end, cursor := len(keys), ""
+		if start+2 < end {
+			end, cursor = start+2, strconv.Itoa(start+2)
+		}
+		var names []string
+		for _, k := range keys[start:end] {
+			name, _ := json.Marshal(k)
+			names = append(names, `{"name":`+string(name)+`}`)
+		}
+		fmt.Fprintf(w, `{"success":true,"errors":[],"messages":[],"result":[%v],"result_info":{"count":%v,"cursor":%q}}`,
+			strings.Join(names, ","), len(names), cursor)
+	case kind == "bulk" && req.Method == http.MethodPut:
+		var pairs []kvBulkPair
+		if err := json.NewDecoder(req.Body).Decode(&pairs); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, pair := range pairs {
+			data := []byte(pair.Value)
+			if pair.Base64 {
+				data, _ = base64.StdEncoding.DecodeString(pair.Value)
+			}
+			f.values[pair.Key] = data
+		}
+		envelope("null")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+//the Workers KV backend against a fake of the api
+func TestKVBackend(t *testing.T) {
+	kv, _ := newFakeKV(t)
+	testBackend(t, kv)
+}
+
+//files saved through the bulk endpoint come back whole
+func TestKVRepo(t *testing.T) {
+	kv, f := newFakeKV(t)
+	dir := t.TempDir()
+	r := NewRepo(kv, 0)
+	var names []string
+	for i, size := range []int{100, 2000, 3 * MinChunkSize} {
+		name := writeRandomFile(t, dir, strconv.Itoa(i), int64(i), size)
+		if _, _, _, err := r.SaveFile("", name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if lost := r.Flush(); len(lost) != 0 {
+		t.Fatalf("lost %v", lost)
+	}
+	if len(f.values) == 0 {
+		t.Fatal("nothing was stored")
+	}
+	for _, name := range names {
+		checkRestore(t, NewRepo(kv, 0), Md5file(name), name)
+	}
+}
+
+//the bulk body is streamed, a retried request must carry the same pairs as the first
+func TestKVPutBatchStreams(t *testing.T) {
+	items := []BatchItem{
+		{Key: "manifests/a", Value: []byte(`{"name":"a \"quoted\"\nfile"}`)},
+		{Key: "chunks/b", Value: []byte{0xff, 0x00, 0xfe, 0x80}},
+		{Key: "chunks/c", Value: bytes.Repeat([]byte{0x9c}, 100000)},
+	}
+
+	var mu sync.Mutex
+	var bodies [][]kvBulkPair
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPut || !strings.HasSuffix(req.URL.Path, "/storage/kv/namespaces/ns/bulk") {
+			t.Errorf("unexpected request %v %v", req.Method, req.URL.Path)
+		}
+		if req.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("missing the api token")
+		}
+		var pairs []kvBulkPair
+		if err := json.NewDecoder(req.Body).Decode(&pairs); err != nil {
+			t.Errorf("decoding the bulk body: %v", err)
+		}
+		mu.Lock()
+		bodies = append(bodies, pairs)
+		first := len(bodies) == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"success":true,"errors":[],"messages":[],"result":null}`)
+	}))
+	defer server.Close()
+
+	kv := NewKV(&Account{Account: "acct", Namespace: "ns", Token: "token"})
+	kv.api = server.URL
+	if err := kv.PutBatch(items); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bodies) != 2 {
+		t.Fatalf("got %v requests, want 2", len(bodies))
+	}
+	for n, pairs := range bodies {
+		if len(pairs) != len(items) {
+			t.Fatalf("request %v: got %v pairs, want %v", n, len(pairs), len(items))
+		}
+		for i, pair := range pairs {
+			value := []byte(pair.Value)
+			if pair.Base64 {
+				var err error
+				if value, err = base64.StdEncoding.DecodeString(pair.Value); err != nil {
+					t.Fatalf("request %v: %v: %v", n, pair.Key, err)
+				}
+			}
+			if pair.Key != items[i].Key || !bytes.Equal(value, items[i].Value) {
+				t.Errorf("request %v: pair %v is %v with %v bytes, want %v with %v bytes", n, i, pair.Key, len(value), items[i].Key, len(items[i].Value))
+			}
+		}
+	}
+	if bodies[1][0].Base64 || !bodies[1][1].Base64 {
+		t.Errorf("text values should be sent as is and binary values base64 encoded")
+	}
+}
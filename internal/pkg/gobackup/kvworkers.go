@@ -1,13 +1,15 @@
 package gobackup
 
 import (
-	"bytes"
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"unicode/utf8"
 )
 
 //validate that the preferences file has all the correct fields
@@ -37,177 +39,259 @@ func ValidateCF(cloud *Account) bool {
 	return pass
 }
 
-//get the stored keys on the account
-func GetKVkeys(cf *Account) {
-	client := &http.Client{}
+//KV stores objects in a cloudflare Workers KV namespace
+type KV struct {
+	cf     *Account
+	api    string //cloudflare api root
+	client *httpClient
+}
 
-	//buffer to store our request body as bytes
-	var requestBody bytes.Buffer
+//create a Workers KV backend using the credentials in cf
+func NewKV(cf *Account) *KV {
+	return &KV{cf: cf, api: "https://api.cloudflare.com/client/v4", client: newHTTPClient(cfErrors)}
+}
 
-	//request     accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier/values/:key_name
-	//request GET accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier/keys
-	request := "https://api.cloudflare.com/client/v4/accounts/" + cf.Account + "/storage/kv/namespaces/" + cf.Namespace + "/keys"
+//base url for the namespace
+//accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier
+func (kv *KV) namespaceURL() string {
+	return kv.api + "/accounts/" + kv.cf.Account + "/storage/kv/namespaces/" + kv.cf.Namespace
+}
 
-	fmt.Println("GET KEY REQUEST:" + request)
-	//get request to get the key data
-	req, err := http.NewRequest("GET", request, &requestBody)
+//build a request with the cloudflare authentication headers
+func (kv *KV) newRequest(method string, request string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, request, body)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 
-	//set the content type -- to verify
-	req.Header.Set("Content-Type", "application/json")
-
 	//for write/read
-
-	if cf.Token != "" {
-		req.Header.Set("Authorization", "Bearer "+cf.Token)
-	} else if cf.Key != "" {
-		req.Header.Set("X-Auth-Key", cf.Key)
+	if kv.cf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+kv.cf.Token)
+	} else if kv.cf.Key != "" {
+		req.Header.Set("X-Auth-Key", kv.cf.Key)
 	}
 
-	req.Header.Set("X-Auth-Email", cf.Email)
+	req.Header.Set("X-Auth-Email", kv.cf.Email)
+	return req, nil
+}
+
+//send the request and turn a non 2xx status into an error
+//rate limited and failed requests are retried, see httpClient
+//the caller must close the body of the returned response
+func (kv *KV) do(req *http.Request) (*http.Response, error) {
+	return kv.client.do(req)
+}
 
-	resp, err := client.Do(req)
+//send a request the api answers with an envelope and check the envelope reports success
+func (kv *KV) call(req *http.Request) error {
+	resp, err := kv.do(req)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-
-	fmt.Println(resp)
-
-	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-
-	fmt.Println(string(body))
+	return cfCheck(body)
 }
 
-//implementation of the workers kv upload
-//filename is a string with the drive location of a file to be uploaded
-func UploadKV(cf *Account, dat *Data1, filename string) bool {
-	//max value size = 25 mb
-
-	fmt.Println("UploadKV starting")
-
-	client := &http.Client{}
-
-	//TODO change BuildData return value to a stream
-	//buildata2 should only build a string as large as 100 MB, must do another upload otherwise
-	//	stringValue, err := BuildData2(dat)
-	//	if err != nil {
-	//		log.Fatalln(err)
-	//	}
-
-	//	value := []byte(stringValue)
-
-	//buffer to store our request body as bytes
-	//	var requestBody bytes.Buffer
-
-	//	requestBody.Write([]byte(value))
-
-	file, err := os.Open(filename)
+//upload the value read from r
+//PUT accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier/values/:key_name
+func (kv *KV) Put(key string, r io.Reader) error {
+	req, err := kv.newRequest(http.MethodPut, kv.namespaceURL()+"/values/"+url.PathEscape(key), r)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return kv.call(req)
+}
 
-	//request with Metadata
-	//	      PUT accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier/values/:key_name?expiration=:expiration&expiration_ttl=:expiration_ttl
-	//bulk request
-	request := "https://api.cloudflare.com/client/v4/accounts/" + cf.Account + "/storage/kv/namespaces/" + cf.Namespace + "/bulk"
-	//request accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier/values/:key_name
+//Workers KV bulk write limits
+//https://api.cloudflare.com/#workers-kv-namespace-write-multiple-key-value-pairs
+const (
+	KVBulkMaxCount = 10000             //the most key/value pairs in one request
+	KVBulkMaxSize  = 100 * 1000 * 1000 //the largest request body
+)
 
-	//normal
-	//	request := "https://api.cloudflare.com/client/v4/accounts/" + cf.Account + "/storage/kv/namespaces/" + cf.Namespace + "/values/" + dataKey
+//a key/value pair as the bulk endpoint expects it
+type kvBulkPair struct {
+	Key      string      `json:"key"`
+	Value    string      `json:"value"`
+	Base64   bool        `json:"base64"`
+	Metadata interface{} `json:"metadata,omitempty"`
+}
 
-	fmt.Println("UPLOAD REQUEST:" + request)
-	//put request to upload the data
-	req, err := http.NewRequest(http.MethodPut, request, file)
+//the most items and bytes the bulk endpoint accepts in one request
+func (kv *KV) BatchLimits() (int, int64) {
+	return KVBulkMaxCount, KVBulkMaxSize
+}
+
+//store every item with a single request to the bulk endpoint
+//binary values are base64 encoded
+//the body is encoded while it is sent, so the batch is not held again as base64 and json
+//PUT accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier/bulk
+func (kv *KV) PutBatch(items []BatchItem) error {
+	req, err := kv.newRequest(http.MethodPut, kv.namespaceURL()+"/bulk", kvBulkBody(items))
 	if err != nil {
-		log.Fatalln(err)
+		return err
+	}
+	//a retry encodes the batch again
+	req.GetBody = func() (io.ReadCloser, error) {
+		return kvBulkBody(items), nil
 	}
-
-	//set the content type -- to verify
 	req.Header.Set("Content-Type", "application/json")
 
-	//for write/read
-
-	if cf.Token != "" {
-		req.Header.Set("Authorization", "Bearer "+cf.Token)
-	} else if cf.Key != "" {
-		req.Header.Set("X-Auth-Key", cf.Key)
+	if err := kv.call(req); err != nil {
+		return fmt.Errorf("bulk write failed: %v", err)
 	}
+	return nil
+}
 
-	req.Header.Set("X-Auth-Email", cf.Email)
+//the json array of key/value pairs the bulk endpoint expects, written to a pipe as it is read
+//binary values are base64 encoded straight into the pipe, a text value is escaped one at a time
+//the request closing the body stops the writer
+func kvBulkBody(items []BatchItem) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(pw)
+		w.WriteString("[")
+		for i, item := range items {
+			if i > 0 {
+				w.WriteString(",")
+			}
+			if utf8.Valid(item.Value) {
+				pair, err := json.Marshal(kvBulkPair{Key: item.Key, Value: string(item.Value)})
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				w.Write(pair)
+				continue
+			}
+			key, err := json.Marshal(item.Key)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			w.WriteString(`{"key":`)
+			w.Write(key)
+			w.WriteString(`,"value":"`)
+			enc := base64.NewEncoder(base64.StdEncoding, w)
+			enc.Write(item.Value)
+			enc.Close()
+			w.WriteString(`","base64":true}`)
+		}
+		w.WriteString("]")
+		pw.CloseWithError(w.Flush())
+	}()
+	return pr
+}
 
-	resp, err := client.Do(req)
+//download the value of key into w
+//GET accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier/values/:key_name
+func (kv *KV) Get(key string, w io.Writer) error {
+	req, err := kv.newRequest(http.MethodGet, kv.namespaceURL()+"/values/"+url.PathEscape(key), nil)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
-	fmt.Println(resp)
-
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	resp, err := kv.do(req)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	fmt.Println(string(body))
-	fmt.Println("Done with uploadKV")
-	return true
-}
-
-//implementation of the workers kv download
-func DownloadKV(cf *Account, dataKey string, filepath string) string {
-
-	client := &http.Client{}
-
-	//GET accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier/values/:key_name
-	request := "https://api.cloudflare.com/client/v4/accounts/" + cf.Account + "/storage/kv/namespaces/" + cf.Namespace + "/values/" + dataKey
-
-	req, err := http.NewRequest("GET", request, nil)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	fmt.Println("REQUEST:" + request)
+	defer resp.Body.Close()
 
-	//set the content type -- to verify
-	req.Header.Set("Content-Type", "application/json")
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
 
-	//for write/read
-	if cf.Token != "" {
-		req.Header.Set("Authorization", "Bearer "+cf.Token)
-	} else if cf.Key != "" {
-		req.Header.Set("X-Auth-Key", cf.Key)
+//list the stored keys on the namespace, following the cursor until every page is read
+//GET accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier/keys
+func (kv *KV) List(prefix string) ([]string, error) {
+	var keys []string
+	cursor := ""
+
+	for {
+		query := url.Values{}
+		query.Set("limit", "1000")
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		req, err := kv.newRequest(http.MethodGet, kv.namespaceURL()+"/keys?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := kv.do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			err = cfCheck(body)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Result []struct {
+				Name string `json:"name"`
+			} `json:"result"`
+			ResultInfo struct {
+				Cursor string `json:"cursor"`
+			} `json:"result_info"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+
+		for _, k := range page.Result {
+			keys = append(keys, k.Name)
+		}
+
+		cursor = page.ResultInfo.Cursor
+		if cursor == "" {
+			return keys, nil
+		}
 	}
+}
 
-	req.Header.Set("X-Auth-Email", cf.Email)
-
-	resp, err := client.Do(req)
+//remove key from the namespace
+//DELETE accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier/values/:key_name
+func (kv *KV) Delete(key string) error {
+	req, err := kv.newRequest(http.MethodDelete, kv.namespaceURL()+"/values/"+url.PathEscape(key), nil)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
-	fmt.Println(resp)
-
-	defer resp.Body.Close()
+	err = kv.call(req)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
 
-	out, err := os.Create(filepath)
+//check that key exists, Workers KV does not report the size of a value without downloading it
+//GET accounts/:account_identifier/storage/kv/namespaces/:namespace_identifier/metadata/:key_name
+func (kv *KV) Stat(key string) (ObjectInfo, error) {
+	req, err := kv.newRequest(http.MethodGet, kv.namespaceURL()+"/metadata/"+url.PathEscape(key), nil)
 	if err != nil {
-		fmt.Println(err)
+		return ObjectInfo{}, err
 	}
-	defer out.Close()
 
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
+	resp, err := kv.do(req)
 	if err != nil {
-		fmt.Println(err)
+		return ObjectInfo{}, err
 	}
-
-	return ("Done Downloading!")
-
+	resp.Body.Close()
+	return ObjectInfo{Key: key, Size: -1}, nil
 }
 
 //******* This struct contains the data needed to access the cloudflare infrastructure. It is stored on drive in the file preferences.toml *****
@@ -219,5 +303,67 @@ type Account struct {
 	// Token is used instead of the key and created on cloudflare at https://dash.cloudflare.com/profile/api-tokens
 	// email is the email associated with your cloudflare account
 
-	Account, Data, Email, Namespace, Key, Token, Location, Zip, Backup string
+	// Backend selects where the backups are stored, "kv" is used when it is blank
+
+	Account, Data, Email, Namespace, Key, Token, Location, Zip, Backup, Backend string
+
+	// PackSize is the target size in bytes of the packs small files are bundled into, 0 uses DefaultPackSize
+	PackSize int64
+
+	// Jobs is how many files are hashed and uploaded at once, 0 uses the default
+	Jobs int
+
+	// Catalog is the database recording what was backed up, DefaultCatalogFile is used when it is blank
+	Catalog string
+
+	// Tags are added to every snapshot, comma separated
+	Tags string
+
+	// KeyFile is where the passphrase wrapped repository key is kept, backups are encrypted when it is set
+	// PasswordFile holds the passphrase for unattended runs, GOBACKUP_PASSWORD or a prompt is used when it is blank
+	KeyFile, PasswordFile string
+	// Recipients are age public keys, comma separated, to encrypt to instead of using a key file
+	// Identity is the age identity file that decrypts them, only needed where backups are restored
+	// NameKey is where the key hiding stored names is kept with Recipients, DefaultNameKeyFile is used when it is blank
+	Recipients, Identity, NameKey string
+
+	// Dir is the [dir] section used by the dir backend
+	Dir DirAccount
+	// S3 is the [s3] section used by the s3 backend
+	S3 S3Account
+	// SFTP is the [sftp] section used by the sftp backend
+	SFTP SFTPAccount
+	// WebDAV is the [webdav] section used by the webdav backend
+	WebDAV WebDAVAccount
+}
+
+//settings for the dir backend, stored in the [dir] section of preferences.toml
+type DirAccount struct {
+	Path string // path is the folder that receives the backups, e.g. a mounted NAS or USB disk
+}
+
+//settings for the s3 backend, stored in the [s3] section of preferences.toml
+//leave endpoint blank to use Cloudflare R2 with the account id above
+type S3Account struct {
+	Bucket,
+	Endpoint, // endpoint is the service url, e.g. https://<account>.r2.cloudflarestorage.com or http://localhost:9000 for MinIO
+	Region, // region defaults to "auto" for R2 and "us-east-1" for everything else
+	AccessKey, // accesskey and secretkey are the S3 API credentials, for R2 they are created under "Manage R2 API Tokens"
+	SecretKey string
+}
+
+//settings for the sftp backend, stored in the [sftp] section of preferences.toml
+type SFTPAccount struct {
+	Host, // host is the server name, with an optional :port
+	User,
+	KeyFile, // keyfile is an unencrypted private key, leave blank to only use the ssh agent
+	KnownHosts, // knownhosts must list the server's host key, defaults to ~/.ssh/known_hosts
+	Path string // path is the folder on the server that receives the backups
+}
+
+//settings for the webdav backend, stored in the [webdav] section of preferences.toml
+type WebDAVAccount struct {
+	URL, // url is the folder that receives the backups, e.g. https://cloud.example.com/remote.php/dav/files/<user>/backup
+	User,
+	Password string // password is best set to a Nextcloud/ownCloud app password
 }
@@ -0,0 +1,103 @@
+package gobackup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+//prefix of the keys holding the file metadata saved by each run
+const metadataPrefix = "meta/"
+
+//the type recorded in every metadata record
+const metadataType = "gobackup-metadata"
+
+//MetadataRecord lists the files a backend held at the end of a run
+//it is encrypted like every other value when the repo has a key, so paths, sizes and times stay private
+type MetadataRecord struct {
+	Type  string       `json:"type"`
+	Time  time.Time    `json:"time"`
+	Files []FileRecord `json:"files"`
+}
+
+//the metadata of one file in a MetadataRecord
+type FileRecord struct {
+	Path        string    `json:"path"`
+	Hash        string    `json:"hash"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modtime"`
+	Permissions string    `json:"permissions"`
+	Notes       string    `json:"notes,omitempty"`
+	Chunks      []string  `json:"chunks,omitempty"`
+	Codec       string    `json:"codec,omitempty"`
+}
+
+//the FileRecord of meta
+func fileRecord(meta Metadata) FileRecord {
+	return FileRecord{
+		Path:        string(meta.FileName),
+		Hash:        meta.Hash,
+		Size:        meta.Size,
+		ModTime:     meta.Atime,
+		Permissions: meta.Permissions,
+		Notes:       meta.Notes,
+		Chunks:      meta.Chunks,
+		Codec:       meta.Codec,
+	}
+}
+
+//store the metadata of files as a new record
+//the record key is random, so it tells nothing about the files it lists
+func (r *Repo) SaveMetadata(files []Metadata) error {
+	record := MetadataRecord{Type: metadataType, Time: time.Now().UTC()}
+	for _, f := range files {
+		record.Files = append(record.Files, fileRecord(f))
+	}
+
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return err
+	}
+	key := metadataPrefix + hashToString(id)
+
+	doc, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if doc, err = r.seal(key, doc); err != nil {
+		return err
+	}
+	return r.Put(key, bytes.NewReader(doc))
+}
+
+//download every metadata record, oldest first
+func (r *Repo) LoadMetadata() ([]MetadataRecord, error) {
+	keys, err := r.List(metadataPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []MetadataRecord
+	for _, k := range keys {
+		var buf bytes.Buffer
+		if err := r.Get(k, &buf); err != nil {
+			return nil, err
+		}
+		doc, err := r.open(k, buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		var record MetadataRecord
+		if err := json.Unmarshal(doc, &record); err != nil || record.Type != metadataType {
+			return nil, fmt.Errorf("%v: not a metadata record", k)
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
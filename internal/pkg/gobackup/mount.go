@@ -0,0 +1,154 @@
+package gobackup
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Mount is a mounted snapshot filesystem, see MountSnapshots
+type Mount interface {
+	//wait until the filesystem is unmounted
+	Wait()
+	//unmount the filesystem
+	Unmount() error
+}
+
+//how many bytes of downloaded files a mount keeps unless told otherwise
+const DefaultCacheSize = 1 << 30
+
+//the files a mount downloaded, decrypted and named by their hash
+//once they add up to more than size the least recently opened are removed, an open file can still be read after that
+type mountCache struct {
+	repo *Repo
+	dir  string
+	size int64 //the most bytes kept, 0 for no limit
+
+	mu      sync.Mutex
+	loading map[string]*sync.Mutex //a lock for each file, so it is only downloaded once
+	opening map[string]int         //files being opened, they are not removed
+	used    map[string]time.Time   //cached files by hash, when they were last opened
+	sizes   map[string]int64       //cached files by hash, their size
+	total   int64                  //the size of every cached file
+}
+
+//the cache in dir, which keeps the files left there by an earlier mount
+func newMountCache(r *Repo, dir string, size int64) (*mountCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &mountCache{repo: r, dir: dir, size: size, loading: map[string]*sync.Mutex{}, opening: map[string]int{},
+		used: map[string]time.Time{}, sizes: map[string]int64{}}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		//a download cut short when the last mount ended
+		if strings.HasSuffix(e.Name(), ".part") {
+			os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		if !isMd5(e.Name()) || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		c.used[e.Name()] = info.ModTime()
+		c.sizes[e.Name()] = info.Size()
+		c.total += info.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+//open the cached copy of the file stored under hash, downloading it first when needed
+//the file is downloaded next to its place and renamed once its hash was checked, so the cache never holds a partial file
+func (c *mountCache) open(hash string) (*os.File, error) {
+	c.mu.Lock()
+	lock, ok := c.loading[hash]
+	if !ok {
+		lock = &sync.Mutex{}
+		c.loading[hash] = lock
+	}
+	c.opening[hash]++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.opening[hash]--; c.opening[hash] == 0 {
+			delete(c.opening, hash)
+		}
+		c.mu.Unlock()
+	}()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	name := filepath.Join(c.dir, hash)
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		part := name + ".part"
+		if err := c.repo.RestoreFile(hash, part); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(part, name); err != nil {
+			return nil, err
+		}
+		file, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	//the modification time orders the files for the next mount
+	now := time.Now()
+	os.Chtimes(name, now, now)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total += info.Size() - c.sizes[hash]
+	c.sizes[hash] = info.Size()
+	c.used[hash] = now
+	c.evict()
+	return file, nil
+}
+
+//remove the least recently opened files until the cache fits in its size, files being opened are kept
+//the caller must hold c.mu
+func (c *mountCache) evict() {
+	if c.size <= 0 || c.total <= c.size {
+		return
+	}
+	hashes := make([]string, 0, len(c.used))
+	for hash := range c.used {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return c.used[hashes[i]].Before(c.used[hashes[j]]) })
+
+	for _, hash := range hashes {
+		if c.total <= c.size {
+			return
+		}
+		if c.opening[hash] > 0 {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, hash)); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		c.total -= c.sizes[hash]
+		delete(c.sizes, hash)
+		delete(c.used, hash)
+	}
+}
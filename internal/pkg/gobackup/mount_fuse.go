@@ -0,0 +1,204 @@
+//go:build linux || darwin
+
+package gobackup
+
+import (
+	"context"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+//the snapshot filesystem being served
+//file contents are downloaded on first open into the cache and read from there
+type snapshotFS struct {
+	repo  *Repo
+	cache *mountCache
+}
+
+//the root directory, it holds snapshots/
+type rootNode struct {
+	fs.Inode
+	sfs   *snapshotFS
+	snaps []Snapshot
+}
+
+//snapshots/, a directory for each snapshot and a latest link to the newest
+type snapshotsNode struct {
+	fs.Inode
+	sfs   *snapshotFS
+	snaps []Snapshot
+}
+
+//a directory in a snapshot
+type dirNode struct {
+	fs.Inode
+	sfs  *snapshotFS
+	node Node
+}
+
+//a file in a snapshot
+type fileNode struct {
+	fs.Inode
+	sfs  *snapshotFS
+	node Node
+}
+
+//an open file, read from its copy in the cache
+type fileHandle struct {
+	file *os.File
+}
+
+//mount the snapshots of r read only at dir, see Mount
+//every snapshot is a directory under dir/snapshots/<id>, file contents are only downloaded when a file is opened
+//cacheDir keeps the downloaded files, decrypted, so each is downloaded once while it stays in the cache
+//the least recently opened files are removed once the cache holds more than cacheSize bytes, 0 keeps every file
+func MountSnapshots(r *Repo, dir string, cacheDir string, cacheSize int64) (Mount, error) {
+	snaps, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	cache, err := newMountCache(r, cacheDir, cacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	sfs := &snapshotFS{repo: r, cache: cache}
+	root := &rootNode{sfs: sfs, snaps: snaps}
+
+	ttl := time.Hour
+	opts := &fs.Options{EntryTimeout: &ttl, AttrTimeout: &ttl}
+	opts.FsName = "goLocBackup"
+	opts.Name = "gobackup"
+	opts.Options = []string{"ro"}
+	//root can mount without fusermount, which containers often lack
+	opts.DirectMount = os.Geteuid() == 0
+	return fs.Mount(dir, root, opts)
+}
+
+func (n *rootNode) OnAdd(ctx context.Context) {
+	dir := &snapshotsNode{sfs: n.sfs, snaps: n.snaps}
+	n.AddChild("snapshots", n.NewPersistentInode(ctx, dir, fs.StableAttr{Mode: syscall.S_IFDIR}), false)
+}
+
+func (n *rootNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0555
+	return 0
+}
+
+func (n *snapshotsNode) OnAdd(ctx context.Context) {
+	for _, snap := range n.snaps {
+		dir := &dirNode{sfs: n.sfs, node: Node{Name: snap.ID, Type: NodeDir, Mode: "dr-xr-xr-x", ModTime: snap.Time, Tree: snap.Tree}}
+		n.AddChild(snap.ID, n.NewPersistentInode(ctx, dir, fs.StableAttr{Mode: syscall.S_IFDIR}), false)
+	}
+	if len(n.snaps) > 0 {
+		latest := &fs.MemSymlink{Data: []byte(n.snaps[len(n.snaps)-1].ID)}
+		n.AddChild("latest", n.NewPersistentInode(ctx, latest, fs.StableAttr{Mode: syscall.S_IFLNK}), false)
+	}
+}
+
+func (n *snapshotsNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0555
+	return 0
+}
+
+//the tree of the directory, an I/O error when it cannot be downloaded
+func (n *dirNode) tree() (*Tree, syscall.Errno) {
+	tree, err := n.sfs.repo.LoadTree(n.node.Tree)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return tree, 0
+}
+
+func (n *dirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	tree, errno := n.tree()
+	if errno != 0 {
+		return nil, errno
+	}
+	entries := make([]fuse.DirEntry, 0, len(tree.Nodes))
+	for _, c := range tree.Nodes {
+		mode := uint32(syscall.S_IFREG)
+		if c.Type == NodeDir {
+			mode = syscall.S_IFDIR
+		}
+		entries = append(entries, fuse.DirEntry{Name: c.Name, Mode: mode})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *dirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	tree, errno := n.tree()
+	if errno != 0 {
+		return nil, errno
+	}
+	for _, c := range tree.Nodes {
+		if c.Name != name {
+			continue
+		}
+		setAttr(c, &out.Attr)
+		if c.Type == NodeDir {
+			return n.NewInode(ctx, &dirNode{sfs: n.sfs, node: c}, fs.StableAttr{Mode: syscall.S_IFDIR}), 0
+		}
+		return n.NewInode(ctx, &fileNode{sfs: n.sfs, node: c}, fs.StableAttr{Mode: syscall.S_IFREG}), 0
+	}
+	return nil, syscall.ENOENT
+}
+
+func (n *dirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	setAttr(n.node, &out.Attr)
+	return 0
+}
+
+func (n *fileNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	setAttr(n.node, &out.Attr)
+	return 0
+}
+
+//open the file read only, downloading it into the cache first when it is not there yet
+func (n *fileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_APPEND|syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	file, err := n.sfs.cache.open(n.node.Hash)
+	if err != nil {
+		return nil, 0, syscall.EIO
+	}
+	//the contents never change, so the kernel may keep them cached
+	return &fileHandle{file: file}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (h *fileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := h.file.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *fileHandle) Release(ctx context.Context) syscall.Errno {
+	h.file.Close()
+	return 0
+}
+
+//fill in attr from a tree entry
+func setAttr(node Node, attr *fuse.Attr) {
+	mode, ok := parsePermissions(node.Mode)
+	if !ok {
+		mode = 0444
+	}
+	//nothing can be written, whatever the original permissions, and everything belongs to whoever mounted it
+	mode &^= 0222
+	if node.Type == NodeDir {
+		attr.Mode = syscall.S_IFDIR | uint32(mode|0500)
+	} else {
+		attr.Mode = syscall.S_IFREG | uint32(mode|0400)
+		attr.Size = uint64(node.Size)
+	}
+	attr.Owner = fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	attr.SetTimes(nil, &node.ModTime, &node.ModTime)
+}
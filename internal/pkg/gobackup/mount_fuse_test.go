@@ -0,0 +1,83 @@
+//go:build linux
+
+package gobackup
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+//a snapshot mounted with FUSE lists its files and reads them back through the cache
+//it needs /dev/fuse and root or fusermount, e.g. a container started with --device /dev/fuse --cap-add SYS_ADMIN
+func TestMountSnapshots(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("no /dev/fuse:", err)
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil && os.Geteuid() != 0 {
+		t.Skip("mounting needs root or fusermount")
+	}
+
+	dir := t.TempDir()
+	r := NewRepo(newMemBackend(), 0)
+	var files []Metadata
+	for i, name := range []string{"small", "large"} {
+		file := writeRandomFile(t, dir, name, int64(i), 1000+i*3*MinChunkSize)
+		meta, err := FileMeta(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := Replicate([]Target{{Name: "mem", Repo: r}}, &meta); len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		files = append(files, meta)
+	}
+	r.Flush()
+	snap, err := r.SaveSnapshot(files, []string{dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mnt := filepath.Join(t.TempDir(), "mnt")
+	os.Mkdir(mnt, 0755)
+	m, err := MountSnapshots(r, mnt, filepath.Join(t.TempDir(), "cache"), 0)
+	if err != nil {
+		t.Skip("cannot mount here:", err)
+	}
+	defer m.Unmount()
+
+	latest, err := os.Readlink(filepath.Join(mnt, "snapshots", "latest"))
+	if err != nil || latest != snap.ID {
+		t.Fatalf("latest points at %v, want %v: %v", latest, snap.ID, err)
+	}
+	for _, meta := range files {
+		name := string(meta.FileName)
+		mounted := filepath.Join(mnt, "snapshots", snap.ID, name)
+		info, err := os.Stat(mounted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != meta.Size || info.Mode().Perm()&0222 != 0 {
+			t.Fatalf("%v has size %v and mode %v, want size %v read only", mounted, info.Size(), info.Mode(), meta.Size)
+		}
+		got, err := os.ReadFile(mounted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("%v does not read back as it was saved", mounted)
+		}
+		if err := os.WriteFile(mounted, nil, 0644); err == nil {
+			t.Fatalf("%v could be written", mounted)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(mnt, "snapshots", snap.ID, dir))
+	if err != nil || len(entries) != len(files) {
+		t.Fatalf("%v lists %v entries, want %v: %v", dir, len(entries), len(files), err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package gobackup
+
+import "errors"
+
+//snapshots can only be mounted where FUSE is available
+func MountSnapshots(r *Repo, dir string, cacheDir string, cacheSize int64) (Mount, error) {
+	return nil, errors.New("mounting snapshots needs Linux or macOS")
+}
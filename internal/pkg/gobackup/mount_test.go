@@ -0,0 +1,96 @@
+package gobackup
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//the cache keeps the files opened last within its size, a file removed while open can still be read
+func TestMountCache(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRepo(newMemBackend(), 0)
+	var hashes []string
+	for i, name := range []string{"a", "b", "c"} {
+		file := writeRandomFile(t, dir, name, int64(i), 2000)
+		hash, _, _, err := r.SaveFile("", file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	if lost := r.Flush(); len(lost) != 0 {
+		t.Fatalf("lost %v", lost)
+	}
+
+	cacheDir := filepath.Join(dir, "cache")
+	os.MkdirAll(cacheDir, 0700)
+	os.WriteFile(filepath.Join(cacheDir, hashes[2]+".part"), []byte("cut short"), 0600)
+	c, err := newMountCache(r, cacheDir, 4500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := func(want ...string) {
+		t.Helper()
+		entries, err := os.ReadDir(cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		if len(got) != len(want) {
+			t.Fatalf("the cache holds %v, want %v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("the cache holds %v, want %v", got, want)
+			}
+		}
+	}
+	cached()
+
+	open := func(i int) *os.File {
+		t.Helper()
+		f, err := c.open(hashes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	open(0).Close()
+	first := open(1)
+	defer first.Close()
+	cached(sortedStrings(hashes[0], hashes[1])...)
+
+	//a is the least recently opened
+	open(2).Close()
+	cached(sortedStrings(hashes[1], hashes[2])...)
+
+	//b was opened before c, it goes while it is still open
+	open(0).Close()
+	cached(sortedStrings(hashes[0], hashes[2])...)
+	data, err := io.ReadAll(first)
+	if err != nil || len(data) != 2000 {
+		t.Fatalf("read %v bytes of a removed file: %v", len(data), err)
+	}
+
+	//a new mount starts from the files left in the cache
+	again, err := newMountCache(r, cacheDir, 2500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.total != 2000 {
+		t.Fatalf("a cache of 2500 bytes kept %v bytes", again.total)
+	}
+	cached(hashes[0])
+}
+
+func sortedStrings(a string, b string) []string {
+	if b < a {
+		return []string{b, a}
+	}
+	return []string{a, b}
+}
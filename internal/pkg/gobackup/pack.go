@@ -0,0 +1,362 @@
+package gobackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+//target size of a pack when the PackSize preference is not set
+const DefaultPackSize = 4 << 20
+
+//files up to this size are bundled into packs instead of being stored as a manifest and a chunk
+const SmallFileSize = MinChunkSize
+
+//prefix of the keys holding pack indexes, the index of pack <hash> is stored under index/<hash>
+const packIndexPrefix = "index/"
+
+//RangeGetter is implemented by backends that can download part of a value
+//packed files are read with it so restoring one file does not download its whole pack
+type RangeGetter interface {
+	GetRange(key string, offset int64, length int64, w io.Writer) error
+}
+
+//where a packed file is stored inside its pack
+type PackEntry struct {
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Codec  string `json:"codec,omitempty"` //the compression of the file, blank for none
+}
+
+//PackIndex is stored next to each pack and lists the files it holds
+type PackIndex struct {
+	Pack  string      `json:"pack"`
+	Files []PackEntry `json:"files"`
+}
+
+//a pack being filled during a run
+type packBuffer struct {
+	data  bytes.Buffer
+	files []PackEntry
+}
+
+//add a small file stored under key, already compressed with codec, to the current pack
+//the pack is uploaded once it reaches the pack size, so the file only reaches the backend then, see Flush
+//each file is encrypted on its own so it can still be read out of the pack with a ranged read
+//a file an earlier pack holds, e.g. one that was renamed or copied since, is not packed again
+func (r *Repo) savePacked(key string, data []byte, codec string) error {
+	//hosts that cannot decrypt cannot read the indexes either, they pack every file
+	if r.canRead() {
+		_, found, err := r.findPacked(key)
+		if err != nil {
+			return err
+		}
+		if found && !r.isLost(key) {
+			return nil
+		}
+	}
+
+	data, err := r.seal(key, data)
+	if err != nil {
+		return err
+	}
+	entry := PackEntry{Hash: key}
+	if codec != CodecNone {
+		entry.Codec = codec
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	//already waiting in this pack
+	for _, f := range r.pack.files {
+		if f.Hash == key {
+			return nil
+		}
+	}
+
+	entry.Offset, entry.Length = int64(r.pack.data.Len()), int64(len(data))
+	r.pack.files = append(r.pack.files, entry)
+	r.pack.data.Write(data)
+
+	if int64(r.pack.data.Len()) >= r.packSize {
+		r.flushPack()
+	}
+	return nil
+}
+
+//upload the current pack and its index, the caller must hold r.mu
+//the pack is stored under the sha256 of its data, so like a chunk its key names its content
+//when the upload fails the files are remembered in r.lost for Flush to report
+func (r *Repo) flushPack() {
+	if len(r.pack.files) == 0 {
+		return
+	}
+	files := r.pack.files
+	data := r.pack.data.Bytes()
+	r.pack = packBuffer{}
+
+	var owners []string
+	for _, f := range files {
+		owners = append(owners, f.Hash)
+	}
+
+	index := PackIndex{Pack: chunkHash(data), Files: files}
+	doc, err := json.Marshal(index)
+	if err == nil {
+		doc, err = r.seal(packIndexPrefix+index.Pack, doc)
+	}
+	if err == nil {
+		err = r.put(owners, index.Pack, data)
+	}
+	if err == nil {
+		err = r.put(owners, packIndexPrefix+index.Pack, doc)
+	}
+	if err != nil {
+		fmt.Printf("pack %v failed: %v\n", index.Pack, err)
+		r.stateMu.Lock()
+		r.lost = append(r.lost, owners...)
+		r.stateMu.Unlock()
+		return
+	}
+
+	//on a batch backend the pack is only stored once its batch is sent, see flushBatch
+	if _, ok := r.Backend.(BatchPutter); !ok {
+		r.stateMu.Lock()
+		for _, owner := range owners {
+			r.commit(owner)
+		}
+		r.stateMu.Unlock()
+	}
+
+	if r.index != nil {
+		for _, f := range files {
+			r.index[f.Hash] = packLocation{pack: index.Pack, entry: f}
+		}
+	}
+}
+
+//upload the last, partly filled pack and batch
+//returns the keys of the files whose pack or batch could not be uploaded during the run, they are not stored on the backend
+func (r *Repo) Flush() []string {
+	r.mu.Lock()
+	r.flushPack()
+	r.mu.Unlock()
+
+	if bp, ok := r.Backend.(BatchPutter); ok {
+		r.batchMu.Lock()
+		r.flushBatch(bp)
+		r.batchMu.Unlock()
+	}
+
+	r.stateMu.Lock()
+	lost := r.lost
+	r.lost = nil
+	r.stateMu.Unlock()
+
+	//a pack that was lost with its batch is not there to be shared
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range lost {
+		delete(r.index, key)
+	}
+	return lost
+}
+
+//is the file stored under key in a pack or batch that failed to upload
+func (r *Repo) isLost(key string) bool {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	for _, f := range r.lost {
+		if f == key {
+			return true
+		}
+	}
+	return false
+}
+
+//where a packed file can be found
+type packLocation struct {
+	pack  string
+	entry PackEntry
+}
+
+//find the pack holding the file stored under key
+//the pack indexes are downloaded once and kept for the life of the repo
+func (r *Repo) findPacked(key string) (packLocation, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.index == nil {
+		keys, err := r.List(packIndexPrefix)
+		if err != nil {
+			return packLocation{}, false, err
+		}
+
+		index := map[string]packLocation{}
+		for _, k := range keys {
+			var buf bytes.Buffer
+			if err := r.Get(k, &buf); err != nil {
+				return packLocation{}, false, err
+			}
+			doc, err := r.open(k, buf.Bytes())
+			if err != nil {
+				return packLocation{}, false, err
+			}
+			var pi PackIndex
+			if err := json.Unmarshal(doc, &pi); err != nil {
+				return packLocation{}, false, fmt.Errorf("%v: %v", k, err)
+			}
+			for _, f := range pi.Files {
+				index[f.Hash] = packLocation{pack: pi.Pack, entry: f}
+			}
+		}
+		r.index = index
+	}
+
+	loc, ok := r.index[key]
+	return loc, ok, nil
+}
+
+//copy a packed file into w
+//backends that support ranged reads only send the file, otherwise the whole pack is fetched and kept for the next file
+func (r *Repo) readPacked(loc packLocation, w io.Writer) error {
+	data, err := r.readPackRange(loc)
+	if err != nil {
+		return err
+	}
+	if data, err = r.open(loc.entry.Hash, data); err != nil {
+		return err
+	}
+	if data, err = decompress(loc.entry.Codec, data); err != nil {
+		return fmt.Errorf("%v: %v", loc.entry.Hash, err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+//get the bytes of a packed file as they are stored in the pack
+func (r *Repo) readPackRange(loc packLocation) ([]byte, error) {
+	if rg, ok := r.Backend.(RangeGetter); ok {
+		var data bytes.Buffer
+		err := rg.GetRange(loc.pack, loc.entry.Offset, loc.entry.Length, &data)
+		return data.Bytes(), err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.lastPack != loc.pack {
+		var data bytes.Buffer
+		if err := r.Get(loc.pack, &data); err != nil {
+			return nil, err
+		}
+		r.lastPack, r.lastPackData = loc.pack, data.Bytes()
+	}
+
+	end := loc.entry.Offset + loc.entry.Length
+	if end > int64(len(r.lastPackData)) {
+		return nil, fmt.Errorf("pack %v is shorter than its index", loc.pack)
+	}
+	return r.lastPackData[loc.entry.Offset:end], nil
+}
+
+//read length bytes at offset from the file stored under key
+func (d *Dir) GetRange(key string, offset int64, length int64, w io.Writer) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, io.NewSectionReader(file, offset, length))
+	return err
+}
+
+//read length bytes at offset from the file stored under key
+func (s *SFTP) GetRange(key string, offset int64, length int64, w io.Writer) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	file, err := s.client.Open(name)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, io.NewSectionReader(file, offset, length))
+	return err
+}
+
+//read length bytes at offset from key with a Range request
+//a service that ignores the range sends the whole value, which is then skipped to the right place
+func (s *S3) GetRange(key string, offset int64, length int64, w io.Writer) error {
+	req, err := s.newRequest("GET", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	//the range header has to be signed along with the rest
+	s.sign(req, nil, time.Now().UTC())
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 206 {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(w, io.LimitReader(resp.Body, length))
+	return err
+}
+
+//read length bytes at offset from key with a Range request
+//servers that ignore the range send the whole value, which is then skipped to the right place
+func (wd *WebDAV) GetRange(key string, offset int64, length int64, w io.Writer) error {
+	name, err := wd.path(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := wd.newRequest("GET", name, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := wd.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 206 {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(w, io.LimitReader(resp.Body, length))
+	return err
+}
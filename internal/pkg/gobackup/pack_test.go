@@ -0,0 +1,75 @@
+package gobackup
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+//small files are packed, read back with and without ranged reads, and a copy is not packed again
+func TestPackRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := NewDir(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewRepoKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range []Backend{newMemBackend(), disk} {
+		var names []string
+		for i := 0; i < 5; i++ {
+			names = append(names, writeRandomFile(t, dir, "small"+string(rune('a'+i)), int64(i), 1000*(i+1)))
+		}
+
+		r := NewRepo(b, 3000)
+		r.SetKey(key)
+		for _, name := range names {
+			if _, _, _, err := r.SaveFile(filepath.Base(name), name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if lost := r.Flush(); len(lost) != 0 {
+			t.Fatalf("lost %v", lost)
+		}
+		packs, err := r.List(packIndexPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packs) < 2 {
+			t.Fatalf("%v files of 15000 bytes made %v packs of 3000 bytes", len(names), len(packs))
+		}
+
+		//a later run reads the packs back and does not pack the same file again under its key
+		again := NewRepo(b, 3000)
+		again.SetKey(key)
+		for _, name := range names {
+			checkRestore(t, again, filepath.Base(name), name)
+		}
+		if _, _, _, err := again.SaveFile(filepath.Base(names[0]), names[0]); err != nil {
+			t.Fatal(err)
+		}
+		again.Flush()
+		if after, _ := again.List(packIndexPrefix); len(after) != len(packs) {
+			t.Fatalf("saving a packed file again made %v packs, there were %v", len(after), len(packs))
+		}
+	}
+}
+
+//a ranged read from S3 returns the bytes asked for, whether or not the service honours the range
+func TestS3GetRange(t *testing.T) {
+	s, f := newFakeS3(t)
+	value := []byte("0123456789abcdefghij")
+	if err := s.Put("packs/p", bytes.NewReader(value)); err != nil {
+		t.Fatal(err)
+	}
+	for _, ranges := range []bool{true, false} {
+		f.ranges = ranges
+		var buf bytes.Buffer
+		if err := s.GetRange("packs/p", 10, 6, &buf); err != nil || buf.String() != "abcdef" {
+			t.Fatalf("with ranges %v read %q: %v", ranges, buf.String(), err)
+		}
+	}
+}
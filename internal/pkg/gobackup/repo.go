@@ -0,0 +1,492 @@
+package gobackup
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+//Repo stores files on a backend as deduplicated, content defined chunks
+//each chunk is stored under the sha256 of its data and each file under its Md5file hash as a Manifest
+//the two hash lengths never collide, so chunks and manifests can share one namespace
+//with a key both hashes are hidden behind a keyed MAC of the same length
+type Repo struct {
+	Backend
+
+	//locks are taken in the order mu, batchMu, stateMu
+
+	//small files are bundled into packs, see pack.go
+	mu           sync.Mutex
+	packSize     int64
+	pack         packBuffer
+	index        map[string]packLocation //packed files, loaded on first use
+	lastPack     string                  //the last whole pack downloaded
+	lastPackData []byte
+
+	//values waiting for a bulk upload, see bulk.go
+	batchMu sync.Mutex
+	batch   batch
+
+	stateMu   sync.Mutex
+	known     map[string]bool  //chunks known to be stored on the backend, by stored key like the batch
+	lost      []string         //files whose pack or batch failed to upload
+	saving    map[string]int   //files SaveFile is still storing, by how many calls
+	committed []string         //files fully stored since the last call to Committed
+	trees     map[string]*Tree //trees already downloaded, they never change
+
+	key         Cipher       //encrypts every stored value, nil stores plaintext
+	compression *Compression //compresses values before they are encrypted, nil stores them as they are
+}
+
+//create a repository on top of b
+//files smaller than SmallFileSize are bundled into packs of about packSize bytes, 0 uses DefaultPackSize
+func NewRepo(b Backend, packSize int64) *Repo {
+	if packSize <= 0 {
+		packSize = DefaultPackSize
+	}
+	return &Repo{Backend: b, known: map[string]bool{}, saving: map[string]int{}, packSize: packSize}
+}
+
+//encrypt every value stored from now on with key and expect every value read to be encrypted with it
+func (r *Repo) SetKey(key Cipher) {
+	r.key = key
+}
+
+//compress every file stored from now on with c, unless its data does not compress
+func (r *Repo) SetCompression(c *Compression) {
+	r.compression = c
+}
+
+//encrypt data stored under name when the repo has a key
+func (r *Repo) seal(name string, data []byte) ([]byte, error) {
+	if r.key == nil {
+		return data, nil
+	}
+	return r.key.Seal(name, data)
+}
+
+//decrypt data stored under name when the repo has a key
+//a value that was altered, or was not encrypted with this key, is rejected
+func (r *Repo) open(name string, data []byte) ([]byte, error) {
+	if r.key == nil {
+		return data, nil
+	}
+	plain, err := r.key.Open(name, data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	return plain, nil
+}
+
+//can the repo read back what it stores, a host encrypting to age recipients without the identity cannot
+func (r *Repo) canRead() bool {
+	k, ok := r.key.(*AgeKey)
+	return !ok || k.canOpen()
+}
+
+//the key the value named by the content hash name is stored under, see Cipher.HideName
+func (r *Repo) storeKey(name string) string {
+	if r.key == nil {
+		return name
+	}
+	return r.key.HideName(name)
+}
+
+//download the value named by the content hash name and decrypt it
+func (r *Repo) getOpen(name string) ([]byte, error) {
+	var buf bytes.Buffer
+	stored := r.storeKey(name)
+	if err := r.Get(stored, &buf); err != nil {
+		return nil, err
+	}
+	return r.open(stored, buf.Bytes())
+}
+
+//the type recorded in every manifest
+const manifestType = "gobackup-manifest"
+
+//Manifest lists the chunks that make up a file, in order
+type Manifest struct {
+	Type   string     `json:"type"`
+	Size   int64      `json:"size"`
+	Codec  string     `json:"codec,omitempty"` //the compression of every chunk, blank for none
+	Chunks []ChunkRef `json:"chunks"`
+}
+
+//a chunk of a file
+type ChunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+//the sha256 of a chunk, used as its key
+func chunkHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hashToString(sum[:])
+}
+
+//split the file called filename into chunks, upload the chunks the backend does not hold yet
+//and store the manifest under key, the hash from Md5file, or under the hash of what was read when key is blank
+//returns the key, the chunk hashes in file order and the codec the file was compressed with
+//files up to SmallFileSize are added to a pack instead and return no chunks, call Flush when done
+func (r *Repo) SaveFile(key string, filename string) (string, []string, string, error) {
+	key, chunks, codec, errs := SaveFile([]*Repo{r}, key, filename)
+	return key, chunks, codec, errs[0]
+}
+
+//store the file called filename under key on every repo in a single pass over the file
+//the file is read once, chunk by chunk, so memory use does not grow with the file
+//each chunk is hashed and compressed once and encrypted for each repo, the first repo's compression settings are used
+//the file is hashed in the same pass, a blank key stores it under the md5 of what was read,
+//otherwise the data read is checked against key and a file that changed since it was hashed is not stored
+//returns the key, the chunk hashes, the codec and for each repo the error that stopped it, nil where the file was stored
+func SaveFile(repos []*Repo, key string, filename string) (string, []string, string, []error) {
+	errs := make([]error, len(repos))
+	fail := func(err error) (string, []string, string, []error) {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return key, nil, "", errs
+	}
+
+	//until the hash is known the chunks are owned by the filename, see adopt
+	owner := key
+	if owner == "" {
+		owner = "\x00" + filename
+	}
+	for _, r := range repos {
+		r.startSave(owner)
+	}
+	defer func() {
+		for i, r := range repos {
+			r.finishSave(owner, errs[i] == nil)
+		}
+	}()
+	//the data read is checked against key, or becomes it
+	setKey := func(sum string) error {
+		if key == "" {
+			key = sum
+			for _, r := range repos {
+				r.adopt(owner, key)
+			}
+			owner = key
+		}
+		if key != sum && isMd5(key) {
+			return fmt.Errorf("%v changed while it was being backed up", filename)
+		}
+		return nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return fail(err)
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	compression := repos[0].compression
+
+	if fi.Size() <= SmallFileSize {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return fail(err)
+		}
+		sum := md5.Sum(data)
+		if err := setKey(hashToString(sum[:])); err != nil {
+			return fail(err)
+		}
+		codec := compression.codecFor(data)
+		if data, err = compression.compress(codec, data); err != nil {
+			return fail(err)
+		}
+		for i, r := range repos {
+			errs[i] = r.savePacked(key, data, codec)
+		}
+		return key, nil, codec, errs
+	}
+
+	//a sample from the start decides whether the file is worth compressing
+	sample := make([]byte, compressSample)
+	n, err := file.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		return fail(err)
+	}
+	codec := compression.codecFor(sample[:n])
+
+	manifest := Manifest{Type: manifestType}
+	if codec != CodecNone {
+		manifest.Codec = codec
+	}
+	var hashes []string
+
+	sum := md5.New()
+	chunker := NewChunker(io.TeeReader(file, sum))
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		chunk := &pendingChunk{hash: chunkHash(data), codec: codec, data: data, compression: compression}
+		for i, r := range repos {
+			if errs[i] == nil {
+				errs[i] = r.saveChunk(owner, chunk)
+			}
+		}
+		manifest.Chunks = append(manifest.Chunks, ChunkRef{Hash: chunk.hash, Size: int64(len(data))})
+		manifest.Size += int64(len(data))
+		hashes = append(hashes, chunk.hash)
+	}
+	if err := setKey(hashToString(sum.Sum(nil))); err != nil {
+		return fail(err)
+	}
+
+	doc, err := json.Marshal(manifest)
+	if err != nil {
+		return fail(err)
+	}
+	for i, r := range repos {
+		if errs[i] != nil {
+			continue
+		}
+		stored := r.storeKey(key)
+		sealed, err := r.seal(stored, doc)
+		if err == nil {
+			err = r.put([]string{key}, stored, sealed)
+		}
+		errs[i] = err
+	}
+	return key, hashes, codec, errs
+}
+
+//mark the file stored under key as being saved, a flush does not commit it before finishSave
+func (r *Repo) startSave(key string) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	r.saving[key]++
+}
+
+//mark the file stored under key as saved, stored tells whether every value it needs was handed to the backend
+//a stored file that is not waiting in a pack or batch has reached the backend and is committed, see Committed
+func (r *Repo) finishSave(key string, stored bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batchMu.Lock()
+	defer r.batchMu.Unlock()
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	r.saving[key]--
+	if r.saving[key] > 0 {
+		return
+	}
+	delete(r.saving, key)
+	if !stored || r.batch.files[key] {
+		return
+	}
+	for _, f := range r.pack.files {
+		if f.Hash == key {
+			return
+		}
+	}
+	r.commit(key)
+}
+
+//hand what the file saved under the provisional owner waits on over to key, once SaveFile has hashed it
+func (r *Repo) adopt(owner string, key string) {
+	r.batchMu.Lock()
+	defer r.batchMu.Unlock()
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	if r.batch.files[owner] {
+		delete(r.batch.files, owner)
+		r.batch.files[key] = true
+	}
+	r.saving[key] += r.saving[owner]
+	delete(r.saving, owner)
+	for i, f := range r.lost {
+		if f == owner {
+			r.lost[i] = key
+		}
+	}
+}
+
+//record that every value of the file stored under key is on the backend
+//files still being saved are left for finishSave and files with a failed pack or batch are left out
+//the caller must hold r.stateMu
+func (r *Repo) commit(key string) {
+	if r.saving[key] > 0 {
+		return
+	}
+	for _, f := range r.lost {
+		if f == key {
+			return
+		}
+	}
+	r.committed = append(r.committed, key)
+}
+
+//the keys of the files that fully reached the backend since the last call
+//a file is only listed once every chunk, pack and manifest it needs is stored, so a run cut short after this can skip it
+func (r *Repo) Committed() []string {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	committed := r.committed
+	r.committed = nil
+	return committed
+}
+
+//a chunk on its way to one or more repos
+//it is only compressed when a repo is missing it, and then only once
+type pendingChunk struct {
+	hash        string
+	codec       string
+	data        []byte
+	compression *Compression
+
+	packed     []byte
+	compressed bool
+}
+
+//the chunk data compressed with its codec
+func (c *pendingChunk) compress() ([]byte, error) {
+	if !c.compressed {
+		packed, err := c.compression.compress(c.codec, c.data)
+		if err != nil {
+			return nil, err
+		}
+		c.packed, c.compressed = packed, true
+	}
+	return c.packed, nil
+}
+
+//upload a chunk of the file stored under owner unless the backend already holds it
+//this is where identical data in other files or older versions is deduplicated
+func (r *Repo) saveChunk(owner string, chunk *pendingChunk) error {
+	name := chunkName(chunk.hash, chunk.codec)
+	stored := r.storeKey(name)
+
+	r.stateMu.Lock()
+	known := r.known[stored]
+	r.stateMu.Unlock()
+	if known {
+		r.joinBatch(owner, stored)
+		return nil
+	}
+
+	_, err := r.Stat(stored)
+	if err == ErrNotFound {
+		var sealed []byte
+		if sealed, err = chunk.compress(); err == nil {
+			if sealed, err = r.seal(stored, sealed); err == nil {
+				err = r.put([]string{owner}, stored, sealed)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	r.stateMu.Lock()
+	r.known[stored] = true
+	r.stateMu.Unlock()
+	return nil
+}
+
+//download a chunk stored with codec into w after checking it against its hash
+func (r *Repo) loadChunk(hash string, codec string, w io.Writer) error {
+	var buf bytes.Buffer
+	stored := r.storeKey(chunkName(hash, codec))
+	if err := r.Get(stored, &buf); err != nil {
+		return fmt.Errorf("chunk %v: %v", hash, err)
+	}
+	data, err := r.open(stored, buf.Bytes())
+	if err == nil {
+		data, err = decompress(codec, data)
+	}
+	if err != nil {
+		return fmt.Errorf("chunk %v: %v", hash, err)
+	}
+	if chunkHash(data) != hash {
+		return fmt.Errorf("chunk %v: data does not match the hash", hash)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+//rebuild the file stored under key into a new file at filepath, see Restore
+//the file is removed again when it could not be fully restored
+func (r *Repo) RestoreFile(key string, filepath string) error {
+	out, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	err = r.Restore(key, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filepath)
+	}
+	return err
+}
+
+//rebuild the file stored under key into w
+//small files are read out of their pack
+//values stored whole before chunking was added are still read
+//every value is decrypted and authenticated when the repo has a key
+//when key is an md5 hash the rebuilt file is checked against it, once all of it was written
+func (r *Repo) Restore(key string, out io.Writer) error {
+	value, err := r.getOpen(key)
+	var packed packLocation
+	found := false
+	if err == ErrNotFound {
+		packed, found, err = r.findPacked(key)
+		if err == nil && !found {
+			err = ErrNotFound
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	hash := md5.New()
+	w := io.MultiWriter(out, hash)
+
+	var manifest Manifest
+	switch {
+	case found:
+		err = r.readPacked(packed, w)
+	case json.Unmarshal(value, &manifest) == nil && manifest.Type == manifestType:
+		for _, c := range manifest.Chunks {
+			if err = r.loadChunk(c.Hash, manifest.Codec, w); err != nil {
+				break
+			}
+		}
+	default:
+		_, err = w.Write(value)
+	}
+	if err != nil {
+		return err
+	}
+
+	if isMd5(key) && hashToString(hash.Sum(nil)) != key {
+		return fmt.Errorf("%v: downloaded data does not match the hash", key)
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package gobackup
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//RestoreOptions selects what RestoreSnapshot restores and how
+type RestoreOptions struct {
+	//only files matching one of Include are restored, all files when it is empty, see MatchGlob
+	Include []string
+	//files matching one of Exclude are left out, as are the files below a directory matching one
+	Exclude []string
+	//how many files are downloaded at once
+	Jobs int
+}
+
+//should the file at path be restored
+func (o RestoreOptions) selected(path string) bool {
+	for _, pattern := range o.Exclude {
+		if MatchGlob(pattern, path) {
+			return false
+		}
+	}
+	if len(o.Include) == 0 {
+		return true
+	}
+	for _, pattern := range o.Include {
+		if MatchGlob(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+//does the glob pattern match the slash separated path or a directory it is in
+//a pattern is matched a name at a time with path.Match, so * does not cross a slash
+//a pattern starting with / is matched from the root, e.g. /home/*/Documents,
+//other patterns anywhere in the path, e.g. *.xlsx matches every spreadsheet and node_modules every such directory
+func MatchGlob(pattern string, path string) bool {
+	anchored := strings.HasPrefix(pattern, "/")
+	want := strings.Split(strings.Trim(pattern, "/"), "/")
+	names := strings.Split(strings.Trim(path, "/"), "/")
+
+	for start := 0; start+len(want) <= len(names); start++ {
+		matched := true
+		for i, w := range want {
+			if ok, _ := pathpkg.Match(w, names[start+i]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+		if anchored {
+			break
+		}
+	}
+	return false
+}
+
+//what RestoreSnapshot did
+type RestoreStats struct {
+	Files     int     //files downloaded
+	Unchanged int     //files already in place with the right content
+	Dirs      int     //directories created or updated
+	Errors    []error //files and directories that could not be restored
+}
+
+//a file waiting to be restored
+type restoreFile struct {
+	node Node
+	path string //where it goes under the destination
+}
+
+//a snapshot being restored
+//directory permissions and times are only applied at the end, so a read only directory does not stop its files
+type restoration struct {
+	repo  *Repo
+	dest  string
+	opts  RestoreOptions
+	dirs  map[string]Node
+	files chan restoreFile
+
+	mu    sync.Mutex
+	stats RestoreStats
+}
+
+func (x *restoration) fail(err error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.stats.Errors = append(x.stats.Errors, err)
+}
+
+//rebuild the entry at path in snap, and everything below it that opts selects, under dest
+//each entry lands at its original path under dest, e.g. /etc/hosts is restored to <dest>/etc/hosts
+//files are checked against their hash, permissions and modification times are restored too
+//a file that cannot be restored is reported in the stats and the others are still restored
+func (r *Repo) RestoreSnapshot(snap *Snapshot, path string, dest string, opts RestoreOptions) (RestoreStats, error) {
+	node, err := r.FindNode(snap, path)
+	if err != nil {
+		return RestoreStats{}, err
+	}
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	path = "/" + strings.Trim(filepath.ToSlash(filepath.Clean(path)), "/")
+
+	x := &restoration{repo: r, dest: dest, opts: opts, dirs: map[string]Node{}, files: make(chan restoreFile)}
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range x.files {
+				if err := x.file(f); err != nil {
+					x.fail(fmt.Errorf("%v: %v", f.path, err))
+				}
+			}
+		}()
+	}
+
+	x.walk(node, path)
+	close(x.files)
+	wg.Wait()
+
+	x.finish()
+	return x.stats, nil
+}
+
+//restore node, found at path in the snapshot
+//selected files are handed to the workers, which create the directories they need
+func (x *restoration) walk(node Node, path string) {
+	if node.Type != NodeDir {
+		if x.opts.selected(path) {
+			x.files <- restoreFile{node: node, path: path}
+		}
+		return
+	}
+	for _, pattern := range x.opts.Exclude {
+		if MatchGlob(pattern, path) {
+			return
+		}
+	}
+
+	local, err := extractPath(x.dest, strings.TrimPrefix(path, "/"))
+	if err != nil {
+		x.fail(fmt.Errorf("%v: %v", path, err))
+		return
+	}
+	x.dirs[local] = node
+
+	tree, err := x.repo.LoadTree(node.Tree)
+	if err != nil {
+		x.fail(fmt.Errorf("%v: %v", path, err))
+		return
+	}
+	for _, n := range tree.Nodes {
+		if n.Name == "" || n.Name == "." || n.Name == ".." || strings.ContainsAny(n.Name, `/\`) {
+			x.fail(fmt.Errorf("%v: bad name %q in the snapshot", path, n.Name))
+			continue
+		}
+		x.walk(n, strings.TrimSuffix(path, "/")+"/"+n.Name)
+	}
+}
+
+//download a file next to where it goes, then move it into place once its hash was checked
+//a file that is already there with the right content is left as it is
+func (x *restoration) file(f restoreFile) error {
+	local, err := extractPath(x.dest, strings.TrimPrefix(f.path, "/"))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(local), 0700); err != nil {
+		return err
+	}
+
+	unchanged := false
+	if fi, err := os.Lstat(local); err == nil && fi.Mode().IsRegular() && fi.Size() == f.node.Size {
+		unchanged = fileMatches(local, f.node.Hash)
+	}
+	if !unchanged {
+		part := local + ".restoring"
+		if err := x.repo.RestoreFile(f.node.Hash, part); err != nil {
+			return err
+		}
+		if err := os.Rename(part, local); err != nil {
+			os.Remove(part)
+			return err
+		}
+	}
+
+	if mode, ok := parsePermissions(f.node.Mode); ok {
+		if err := os.Chmod(local, mode); err != nil {
+			return err
+		}
+	}
+	if !f.node.ModTime.IsZero() {
+		if err := os.Chtimes(local, f.node.ModTime, f.node.ModTime); err != nil {
+			return err
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if unchanged {
+		x.stats.Unchanged++
+	} else {
+		x.stats.Files++
+	}
+	return nil
+}
+
+//does the file called name have the md5 hash
+func fileMatches(name string, hash string) bool {
+	if !isMd5(hash) {
+		return false
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	sum := md5.New()
+	if _, err := io.Copy(sum, file); err != nil {
+		return false
+	}
+	return hashToString(sum.Sum(nil)) == hash
+}
+
+//apply the directory permissions and times, deepest directories first
+//directories no file was restored into were not created and are skipped
+func (x *restoration) finish() {
+	dirs := make([]string, 0, len(x.dirs))
+	for d := range x.dirs {
+		dirs = append(dirs, d)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		node := x.dirs[d]
+		if _, err := os.Stat(d); err != nil {
+			continue
+		}
+		if !node.ModTime.IsZero() {
+			os.Chtimes(d, node.ModTime, node.ModTime)
+		}
+		if mode, ok := parsePermissions(node.Mode); ok {
+			if err := os.Chmod(d, mode); err != nil {
+				x.fail(err)
+				continue
+			}
+		}
+		x.stats.Dirs++
+	}
+}
+
+//read permissions written by FileMode.String, e.g. -rw-r--r--
+func parsePermissions(s string) (os.FileMode, bool) {
+	if len(s) != 10 {
+		return 0, false
+	}
+	var mode os.FileMode
+	for i := 0; i < 9; i++ {
+		switch c := s[i+1]; {
+		case c == "rwxrwxrwx"[i]:
+			mode |= 1 << uint(8-i)
+		case c != '-':
+			return 0, false
+		}
+	}
+	return mode, true
+}
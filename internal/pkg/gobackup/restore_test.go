@@ -0,0 +1,193 @@
+package gobackup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//back up the files below src to a Dir backend and take a snapshot of them
+func restoreSetup(t *testing.T, src string) (*Repo, Backend, *Snapshot, []Metadata) {
+	t.Helper()
+	disk, err := NewDir(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepo(disk, 0)
+
+	var files []Metadata
+	filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		meta, err := FileMeta(path)
+		if err != nil {
+			return err
+		}
+		if errs := Replicate([]Target{{Name: "dir", Repo: r}}, &meta); len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		files = append(files, meta)
+		return nil
+	})
+	if lost := r.Flush(); len(lost) != 0 {
+		t.Fatalf("lost %v", lost)
+	}
+	snap, err := r.SaveSnapshot(files, []string{src}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, disk, snap, files
+}
+
+//files and directories land below the target with their content, permissions and times
+//files already in place are left as they are, a changed one is downloaded again
+func TestRestoreSnapshot(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	names := []string{
+		writeRandomFile(t, src, "a.txt", 1, 1000),
+		writeRandomFile(t, src, "sub/b.bin", 2, 3*MinChunkSize),
+		writeRandomFile(t, src, "sub/c.txt", 3, 2000),
+	}
+	modTime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, name := range names {
+		os.Chmod(name, 0640)
+		os.Chtimes(name, modTime, modTime)
+	}
+	os.Chmod(filepath.Join(src, "sub"), 0750)
+	os.Chtimes(filepath.Join(src, "sub"), modTime, modTime)
+	r, _, snap, _ := restoreSetup(t, src)
+
+	dest := t.TempDir()
+	stats, err := NewRepo(r.Backend, 0).RestoreSnapshot(snap, src, dest, RestoreOptions{Jobs: 4})
+	if err != nil || len(stats.Errors) != 0 || stats.Files != 3 {
+		t.Fatalf("restored %+v: %v", stats, err)
+	}
+	for _, name := range names {
+		restored := filepath.Join(dest, name)
+		want, _ := os.ReadFile(name)
+		got, err := os.ReadFile(restored)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%v was restored as %v bytes of %v: %v", restored, len(got), len(want), err)
+		}
+		info, _ := os.Stat(restored)
+		if info.Mode().Perm() != 0640 || !info.ModTime().Equal(modTime) {
+			t.Fatalf("%v was restored with mode %v and time %v", restored, info.Mode(), info.ModTime())
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dest, src, "sub")); err != nil || info.Mode().Perm() != 0750 || !info.ModTime().Equal(modTime) {
+		t.Fatalf("the directory was restored as %v: %v", info, err)
+	}
+
+	//same size, other content
+	changed := filepath.Join(dest, names[0])
+	os.Chmod(changed, 0644)
+	os.WriteFile(changed, make([]byte, 1000), 0644)
+	stats, err = r.RestoreSnapshot(snap, src, dest, RestoreOptions{})
+	if err != nil || len(stats.Errors) != 0 || stats.Files != 1 || stats.Unchanged != 2 {
+		t.Fatalf("restoring again %+v: %v", stats, err)
+	}
+	if got, _ := os.ReadFile(changed); bytes.Equal(got, make([]byte, 1000)) {
+		t.Fatal("the changed file was not restored")
+	}
+}
+
+//a file whose download does not match its hash is reported and keeps what was there, the other files are restored
+func TestRestoreSnapshotHashMismatch(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	os.MkdirAll(src, 0755)
+	//larger than SmallFileSize, so each has a manifest of its own
+	good := writeRandomFile(t, src, "good", 1, 2*MinChunkSize)
+	bad := writeRandomFile(t, src, "bad", 2, 2*MinChunkSize)
+	r, disk, snap, files := restoreSetup(t, src)
+
+	//the bad file's key holds the good file's manifest, so it downloads the wrong data
+	hashes := map[string]string{}
+	for _, f := range files {
+		hashes[string(f.FileName)] = f.Hash
+	}
+	var manifest bytes.Buffer
+	if err := disk.Get(hashes[good], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.Put(hashes[bad], &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	old := filepath.Join(dest, bad)
+	os.MkdirAll(filepath.Dir(old), 0755)
+	os.WriteFile(old, []byte("what was there"), 0644)
+
+	stats, err := NewRepo(r.Backend, 0).RestoreSnapshot(snap, "/", dest, RestoreOptions{Jobs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Errors) != 1 || !strings.Contains(stats.Errors[0].Error(), "does not match") || stats.Files != 1 {
+		t.Fatalf("restored %+v", stats)
+	}
+	if got, _ := os.ReadFile(old); string(got) != "what was there" {
+		t.Fatalf("the file that failed was replaced with %q", got)
+	}
+	if _, err := os.Stat(old + ".restoring"); !os.IsNotExist(err) {
+		t.Fatalf("the partial download was left behind: %v", err)
+	}
+	checkRestore(t, r, hashes[good], good)
+	if got, _ := os.ReadFile(filepath.Join(dest, good)); len(got) != 2*MinChunkSize {
+		t.Fatal("the good file was not restored")
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, c := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		//rooted
+		{"/home/*/Documents", "/home/me/Documents", true},
+		{"/home/*/Documents", "/home/me/Documents/report.odt", true},
+		{"/home/*/Documents", "/backup/home/me/Documents/report.odt", false},
+		{"/home/*", "/home", false},
+		//anywhere in the path
+		{"*.xlsx", "/home/me/budget.xlsx", true},
+		{"*.xlsx", "/home/me/budget.xlsx.bak", false},
+		{"me/*.txt", "/home/me/notes.txt", true},
+		{"me/*.txt", "/home/me/old/notes.txt", false},
+		//a directory and everything below it
+		{"node_modules", "/src/app/node_modules/left-pad/index.js", true},
+		{"app/node_modules", "/src/app/node_modules/left-pad/index.js", true},
+		{"/app", "/src/app/main.go", false},
+	} {
+		if got := MatchGlob(c.pattern, c.path); got != c.want {
+			t.Errorf("MatchGlob(%q, %q) = %v, want %v", c.pattern, c.path, got, c.want)
+		}
+	}
+}
+
+//only the included files are restored, an excluded directory is skipped with everything below it
+func TestRestoreSnapshotGlobs(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	os.MkdirAll(filepath.Join(src, "cache"), 0755)
+	writeRandomFile(t, src, "a.txt", 1, 100)
+	writeRandomFile(t, src, "b.log", 2, 100)
+	writeRandomFile(t, src, "cache/c.txt", 3, 100)
+	r, _, snap, _ := restoreSetup(t, src)
+
+	dest := t.TempDir()
+	stats, err := r.RestoreSnapshot(snap, src, dest, RestoreOptions{Include: []string{"*.txt"}, Exclude: []string{"cache"}})
+	if err != nil || len(stats.Errors) != 0 || stats.Files != 1 {
+		t.Fatalf("restored %+v: %v", stats, err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, src, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b.log", "cache"} {
+		if _, err := os.Stat(filepath.Join(dest, src, name)); !os.IsNotExist(err) {
+			t.Fatalf("%v was restored: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package gobackup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//objects larger than this are sent with a multipart upload
+//S3 requires every part except the last to be at least 5 MiB
+const s3PartSize = 16 << 20
+
+//buffers of s3PartSize bytes, shared by the uploads so each Put does not allocate a part
+var s3Parts = sync.Pool{New: func() interface{} {
+	part := make([]byte, s3PartSize)
+	return &part
+}}
+
+//S3 stores objects in a bucket of any S3 compatible service such as Cloudflare R2, MinIO or AWS
+//requests use path style addressing, endpoint/bucket/key, which all three support
+type S3 struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *httpClient
+}
+
+//create an S3 backend from the [s3] preferences
+//when no endpoint is given, the cloudflare account id is used to reach R2
+func NewS3(cf *Account) (*S3, error) {
+	conf := cf.S3
+	if conf.Bucket == "" {
+		return nil, fmt.Errorf("the s3 backend needs a bucket")
+	}
+	if conf.AccessKey == "" || conf.SecretKey == "" {
+		return nil, fmt.Errorf("the s3 backend needs an accesskey and secretkey")
+	}
+
+	endpoint := conf.Endpoint
+	if endpoint == "" {
+		if cf.Account == "" {
+			return nil, fmt.Errorf("the s3 backend needs an endpoint or a cloudflare account for R2")
+		}
+		endpoint = "https://" + cf.Account + ".r2.cloudflarestorage.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	region := conf.Region
+	if region == "" {
+		//R2 accepts "auto", MinIO and AWS default to us-east-1
+		region = "us-east-1"
+		if strings.HasSuffix(u.Host, ".r2.cloudflarestorage.com") {
+			region = "auto"
+		}
+	}
+
+	return &S3{
+		endpoint:  u,
+		bucket:    conf.Bucket,
+		region:    region,
+		accessKey: conf.AccessKey,
+		secretKey: conf.SecretKey,
+		client:    newHTTPClient(s3ErrorMessage),
+	}, nil
+}
+
+//build a signed request for key, query holds the sub resource parameters
+func (s *S3) newRequest(method string, key string, query url.Values, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body = nil
+		req.ContentLength = 0
+	}
+
+	s.sign(req, body, time.Now().UTC())
+	return req, nil
+}
+
+//add an AWS signature version 4 authorization header to req
+//https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+
+	//a request can be signed again after adding headers, the old signature is not part of the new one
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	//canonical headers, sorted by lower case name
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//uri encode s the way SigV4 expects, every byte except A-Z a-z 0-9 - _ . ~ is escaped
+//slashes are kept when encoding a path
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+//build the canonical query string, sorted by name with SigV4 escaping
+func s3Query(query url.Values) string {
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+//the error document returned by S3 services
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+//the code and message of an S3 error document, blank when body is not one
+func s3ErrorMessage(body []byte) string {
+	var serr s3Error
+	if xml.Unmarshal(body, &serr) != nil || serr.Code == "" {
+		return ""
+	}
+	return serr.Code + ": " + serr.Message
+}
+
+//send the request and turn a non 2xx status into an error
+//rate limited and failed requests are retried, see httpClient
+//the caller must close the body of the returned response
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	return s.client.do(req)
+}
+
+//send a request and discard the response body
+func (s *S3) send(method string, key string, query url.Values, body []byte) error {
+	req, err := s.newRequest(method, key, query, body)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//upload the value read from r
+//values that fit in one part are sent with a single PUT, larger values use a multipart upload
+func (s *S3) Put(key string, r io.Reader) error {
+	buf := s3Parts.Get().(*[]byte)
+	defer s3Parts.Put(buf)
+	part := *buf
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.send(http.MethodPut, key, nil, part[:n])
+	}
+	if err != nil {
+		return err
+	}
+	return s.putMultipart(key, part, r)
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+//upload a value in parts, first holds the first full part that has already been read from r
+//the following parts are read into first's buffer, each once the part before it was sent
+//the upload is aborted if any part fails so the bucket is not left holding orphaned parts
+func (s *S3) putMultipart(key string, first []byte, r io.Reader) error {
+	//POST /bucket/key?uploads
+	req, err := s.newRequest(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var parts []s3CompletedPart
+	abort := func(err error) error {
+		s.send(http.MethodDelete, key, url.Values{"uploadId": {initiate.UploadID}}, nil)
+		return err
+	}
+
+	part := first
+	for number := 1; ; number++ {
+		//PUT /bucket/key?partNumber=N&uploadId=ID
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiate.UploadID}}
+		req, err := s.newRequest(http.MethodPut, key, query, part)
+		if err != nil {
+			return abort(err)
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return abort(err)
+		}
+		resp.Body.Close()
+		parts = append(parts, s3CompletedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		n, err := io.ReadFull(r, first)
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+		part = first[:n]
+	}
+
+	//POST /bucket/key?uploadId=ID with the list of parts
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+	err = s.send(http.MethodPost, key, url.Values{"uploadId": {initiate.UploadID}}, complete)
+	if err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+//download the value of key into w
+func (s *S3) Get(key string, w io.Writer) error {
+	req, err := s.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+//list the keys in the bucket with ListObjectsV2, following the continuation token until every page is read
+func (s *S3) List(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := s.newRequest(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range page.Contents {
+			keys = append(keys, c.Key)
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+//remove key from the bucket
+func (s *S3) Delete(key string) error {
+	err := s.send(http.MethodDelete, key, nil, nil)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+//get the size of key with a HEAD request
+func (s *S3) Stat(key string) (ObjectInfo, error) {
+	req, err := s.newRequest(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	return ObjectInfo{Key: key, Size: resp.ContentLength}, nil
+}
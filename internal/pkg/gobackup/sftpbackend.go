@@ -0,0 +1,251 @@
+package gobackup
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//SFTP stores objects as files below a directory on an ssh server
+//the layout matches the dir backend, Path/<first two characters of key>/<key>
+type SFTP struct {
+	root   string
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+//connect to the server in the [sftp] preferences
+//authentication uses the ssh agent from SSH_AUTH_SOCK and/or the private key in keyfile
+//the server's host key must be listed in knownhosts, ~/.ssh/known_hosts by default
+func NewSFTP(cf *Account) (*SFTP, error) {
+	conf := cf.SFTP
+	if conf.Host == "" || conf.User == "" {
+		return nil, fmt.Errorf("the sftp backend needs a host and user")
+	}
+
+	var auth []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if agentConn, err := net.Dial("unix", sock); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		}
+	}
+	if conf.KeyFile != "" {
+		pem, err := ioutil.ReadFile(expandHome(conf.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", conf.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("the sftp backend needs a keyfile or a running ssh agent")
+	}
+
+	knownHosts := conf.KnownHosts
+	if knownHosts == "" {
+		knownHosts = "~/.ssh/known_hosts"
+	}
+	hostKeys, err := knownhosts.New(expandHome(knownHosts))
+	if err != nil {
+		return nil, err
+	}
+
+	host := conf.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+
+	conn, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            conf.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	root := path.Clean(conf.Path)
+	if err := client.MkdirAll(root); err != nil {
+		client.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	return &SFTP{root: root, conn: conn, client: client}, nil
+}
+
+//replace a leading ~ with the home directory
+func expandHome(name string) string {
+	if name == "~" || strings.HasPrefix(name, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, name[1:])
+		}
+	}
+	return name
+}
+
+//close the sftp session and the ssh connection
+func (s *SFTP) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
+
+//the location of key on the server, remote paths always use forward slashes
+func (s *SFTP) path(key string) (string, error) {
+	if len(key) < 2 || strings.HasPrefix(key, "/") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return path.Join(s.root, key[:2], key), nil
+}
+
+//upload r to a temporary file next to the destination and rename it into place
+//the server never exposes a partly written object under key
+func (s *SFTP) Put(key string, r io.Reader) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := s.client.MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+
+	//workers can put the same key at once, so each upload gets its own temporary file
+	suffix := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, suffix); err != nil {
+		return err
+	}
+	temp := path.Join(path.Dir(name), ".tmp-"+path.Base(name)+"-"+hashToString(suffix))
+	file, err := s.client.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.ReadFrom(r)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = s.rename(temp, name)
+	}
+	if err != nil {
+		s.client.Remove(temp)
+	}
+	return err
+}
+
+//rename oldname over newname
+//plain SFTP rename fails when newname exists, so the openssh posix-rename extension is preferred
+func (s *SFTP) rename(oldname string, newname string) error {
+	if _, ok := s.client.HasExtension("posix-rename@openssh.com"); ok {
+		return s.client.PosixRename(oldname, newname)
+	}
+	s.client.Remove(newname)
+	return s.client.Rename(oldname, newname)
+}
+
+//download the file stored under key into w
+func (s *SFTP) Get(key string, w io.Writer) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	file, err := s.client.Open(name)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteTo(w)
+	return err
+}
+
+//walk the remote tree and return every key starting with prefix
+func (s *SFTP) List(prefix string) ([]string, error) {
+	var keys []string
+
+	walker := s.client.Walk(s.root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+		info := walker.Stat()
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			continue
+		}
+
+		rel := walker.Path()
+		if s.root != "." {
+			rel = strings.TrimPrefix(rel, strings.TrimSuffix(s.root, "/")+"/")
+		}
+
+		//drop the two character fan out directory
+		parts := strings.SplitN(rel, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if strings.HasPrefix(parts[1], prefix) {
+			keys = append(keys, parts[1])
+		}
+	}
+	return keys, nil
+}
+
+//remove the file stored under key
+func (s *SFTP) Delete(key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = s.client.Remove(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//get the size of the file stored under key
+func (s *SFTP) Stat(key string) (ObjectInfo, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	fi, err := s.client.Stat(name)
+	if os.IsNotExist(err) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: fi.Size()}, nil
+}
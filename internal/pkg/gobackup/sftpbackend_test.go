@@ -0,0 +1,173 @@
+package gobackup
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//an ssh server on a local port answering the sftp subsystem from the local filesystem
+//only the client key in the returned account may log in, the host key is in its known hosts file
+func newSFTPServer(t *testing.T) *Account {
+	dir := t.TempDir()
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPub, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	allowed, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "backup" || !bytes.Equal(key.Marshal(), allowed.Marshal()) {
+				return nil, fmt.Errorf("unknown key for %v", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	addr := listener.Addr().String()
+	knownHosts := filepath.Join(dir, "known_hosts")
+	os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, hostSigner.PublicKey())+"\n"), 0600)
+
+	//the agent of whoever runs the tests must not be asked
+	t.Setenv("SSH_AUTH_SOCK", "")
+	return &Account{SFTP: SFTPAccount{Host: addr, User: "backup", KeyFile: keyFile, KnownHosts: knownHosts,
+		Path: filepath.Join(dir, "remote", "backup")}}
+}
+
+//serve the sessions of one ssh connection
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				//the payload is the length prefixed subsystem name
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						server, err := sftp.NewServer(channel)
+						if err == nil {
+							server.Serve()
+						}
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTPBackend(t *testing.T) {
+	cf := newSFTPServer(t)
+	s, err := NewSFTP(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testBackend(t, s)
+
+	//the layout matches the dir backend
+	if _, err := os.Stat(filepath.Join(cf.SFTP.Path, "ch", "chunks", "ab")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//workers putting the same key at once each write their own temporary file, the key ends up whole
+func TestSFTPConcurrentPut(t *testing.T) {
+	cf := newSFTPServer(t)
+	s, err := NewSFTP(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	value := make([]byte, 200000)
+	rand.Read(value)
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.Put("chunks/same", bytes.NewReader(value))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := s.Get("chunks/same", &buf); err != nil || !bytes.Equal(buf.Bytes(), value) {
+		t.Fatalf("got %v bytes back from %v: %v", buf.Len(), len(value), err)
+	}
+	entries, err := os.ReadDir(filepath.Join(cf.SFTP.Path, "ch", "chunks"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("the server holds %v entries, want only the key: %v", len(entries), err)
+	}
+}
+
+//a server whose host key is not known is refused
+func TestSFTPUnknownHost(t *testing.T) {
+	cf := newSFTPServer(t)
+	other := newSFTPServer(t)
+	cf.SFTP.KnownHosts = other.SFTP.KnownHosts
+	if s, err := NewSFTP(cf); err == nil {
+		s.Close()
+		t.Fatal("connected to a server with an unknown host key")
+	}
+}
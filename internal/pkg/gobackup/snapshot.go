@@ -0,0 +1,357 @@
+package gobackup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//prefix of the keys holding snapshots, snapshot <id> is stored under snapshots/<id>
+const snapshotPrefix = "snapshots/"
+
+//prefix of the keys holding directory trees, stored under the sha256 of their contents
+const treePrefix = "trees/"
+
+//the types recorded in every snapshot and tree
+const (
+	snapshotType = "gobackup-snapshot"
+	treeType     = "gobackup-tree"
+)
+
+//the types of a Node
+const (
+	NodeFile = "file"
+	NodeDir  = "dir"
+)
+
+//Snapshot records what the backed up locations held at the end of a run
+//it points to the tree of the root directory, and the trees of unchanged directories are shared with earlier snapshots
+type Snapshot struct {
+	Type  string    `json:"type"`
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	Host  string    `json:"host"`
+	Tags  []string  `json:"tags,omitempty"`
+	Paths []string  `json:"paths"` //the locations that were backed up
+	Tree  string    `json:"tree"`  //the root directory
+}
+
+//Tree lists the entries of a directory, sorted by name
+type Tree struct {
+	Type  string `json:"type"`
+	Nodes []Node `json:"nodes"`
+}
+
+//an entry in a Tree
+type Node struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Mode    string    `json:"mode,omitempty"`
+	ModTime time.Time `json:"modtime"`
+	Size    int64     `json:"size,omitempty"`
+	Hash    string    `json:"hash,omitempty"` //the file's key, see Md5file
+	Tree    string    `json:"tree,omitempty"` //the directory's tree
+}
+
+//a directory being collected into a Tree
+type treeDir struct {
+	dirs  map[string]*treeDir
+	files []Node
+}
+
+//sort files into directories by their absolute path
+func buildTree(files []Metadata) (*treeDir, error) {
+	root := &treeDir{dirs: map[string]*treeDir{}}
+	for _, f := range files {
+		path, err := filepath.Abs(string(f.FileName))
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.Split(strings.TrimPrefix(filepath.ToSlash(path), "/"), "/")
+
+		dir := root
+		for _, name := range parts[:len(parts)-1] {
+			sub, ok := dir.dirs[name]
+			if !ok {
+				sub = &treeDir{dirs: map[string]*treeDir{}}
+				dir.dirs[name] = sub
+			}
+			dir = sub
+		}
+		dir.files = append(dir.files, Node{
+			Name:    parts[len(parts)-1],
+			Type:    NodeFile,
+			Mode:    f.Permissions,
+			ModTime: f.Atime,
+			Size:    f.Size,
+			Hash:    f.Hash,
+		})
+	}
+	return root, nil
+}
+
+//store the tree of dir, found at local path, and the trees below it
+//returns the hash of the tree, a tree the backend already holds is not uploaded again
+func (r *Repo) saveTree(dir *treeDir, local string) (string, error) {
+	tree := Tree{Type: treeType, Nodes: dir.files}
+	for name, sub := range dir.dirs {
+		path := filepath.Join(local, name)
+		hash, err := r.saveTree(sub, path)
+		if err != nil {
+			return "", err
+		}
+		node := Node{Name: name, Type: NodeDir, Tree: hash}
+		if fi, err := os.Stat(path); err == nil {
+			node.Mode = fi.Mode().Perm().String()
+			node.ModTime = fi.ModTime()
+		}
+		tree.Nodes = append(tree.Nodes, node)
+	}
+	sort.Slice(tree.Nodes, func(i, j int) bool { return tree.Nodes[i].Name < tree.Nodes[j].Name })
+
+	doc, err := json.Marshal(tree)
+	if err != nil {
+		return "", err
+	}
+	hash := chunkHash(doc)
+	key := treePrefix + r.storeKey(hash)
+
+	_, err = r.Stat(key)
+	if err != ErrNotFound {
+		return hash, err
+	}
+	if doc, err = r.seal(key, doc); err != nil {
+		return "", err
+	}
+	return hash, r.Put(key, bytes.NewReader(doc))
+}
+
+//store a snapshot of files, the locations in paths held them at the end of the run
+func (r *Repo) SaveSnapshot(files []Metadata, paths []string, tags []string) (*Snapshot, error) {
+	root, err := buildTree(files)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := r.saveTree(root, string(filepath.Separator))
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{Type: snapshotType, ID: hashToString(id), Time: time.Now().UTC(), Tags: tags, Tree: tree}
+	snap.Host, _ = os.Hostname()
+	for _, p := range paths {
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		snap.Paths = append(snap.Paths, p)
+	}
+
+	doc, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	key := snapshotPrefix + snap.ID
+	if doc, err = r.seal(key, doc); err != nil {
+		return nil, err
+	}
+	return snap, r.Put(key, bytes.NewReader(doc))
+}
+
+//download every snapshot, oldest first
+func (r *Repo) Snapshots() ([]Snapshot, error) {
+	keys, err := r.List(snapshotPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var snaps []Snapshot
+	for _, k := range keys {
+		var buf bytes.Buffer
+		if err := r.Get(k, &buf); err != nil {
+			return nil, err
+		}
+		doc, err := r.open(k, buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		var snap Snapshot
+		if err := json.Unmarshal(doc, &snap); err != nil || snap.Type != snapshotType {
+			return nil, fmt.Errorf("%v: not a snapshot", k)
+		}
+		snaps = append(snaps, snap)
+	}
+
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.Before(snaps[j].Time) })
+	return snaps, nil
+}
+
+//download the tree stored under hash and check it against the hash
+//trees are kept once downloaded, so walking many snapshots only fetches each directory once
+func (r *Repo) LoadTree(hash string) (*Tree, error) {
+	r.stateMu.Lock()
+	tree, ok := r.trees[hash]
+	r.stateMu.Unlock()
+	if ok {
+		return tree, nil
+	}
+
+	key := treePrefix + r.storeKey(hash)
+	var buf bytes.Buffer
+	if err := r.Get(key, &buf); err != nil {
+		return nil, fmt.Errorf("tree %v: %v", hash, err)
+	}
+	doc, err := r.open(key, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if chunkHash(doc) != hash {
+		return nil, fmt.Errorf("tree %v: data does not match the hash", hash)
+	}
+
+	tree = &Tree{}
+	if err := json.Unmarshal(doc, tree); err != nil || tree.Type != treeType {
+		return nil, fmt.Errorf("tree %v: not a tree", hash)
+	}
+
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	if r.trees == nil {
+		r.trees = map[string]*Tree{}
+	}
+	r.trees[hash] = tree
+	return tree, nil
+}
+
+//find the node at the absolute path in snap, "/" is the root directory
+func (r *Repo) FindNode(snap *Snapshot, path string) (Node, error) {
+	node, found, err := r.findNode(snap, path)
+	if err == nil && !found {
+		err = fmt.Errorf("%v is not in snapshot %v", path, snap.ID)
+	}
+	return node, err
+}
+
+//find the node at path in snap, found is false when there is none
+func (r *Repo) findNode(snap *Snapshot, path string) (Node, bool, error) {
+	node := Node{Name: "/", Type: NodeDir, Tree: snap.Tree}
+	path = strings.Trim(filepath.ToSlash(filepath.Clean(path)), "/")
+	if path == "" || path == "." {
+		return node, true, nil
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		if node.Type != NodeDir {
+			return Node{}, false, nil
+		}
+		tree, err := r.LoadTree(node.Tree)
+		if err != nil {
+			return Node{}, false, err
+		}
+		i := sort.Search(len(tree.Nodes), func(i int) bool { return tree.Nodes[i].Name >= name })
+		if i == len(tree.Nodes) || tree.Nodes[i].Name != name {
+			return Node{}, false, nil
+		}
+		node = tree.Nodes[i]
+	}
+	return node, true, nil
+}
+
+//a version of a file, as it was in one or more snapshots in a row
+type FileVersion struct {
+	Node  Node
+	First *Snapshot //the first snapshot holding this version
+	Last  *Snapshot //the last snapshot holding this version, restore from it to get the version
+	Count int       //how many snapshots hold it
+}
+
+//the versions of the file at path in snaps, which are sorted oldest first
+//a new version starts whenever the file's content changes or it comes back after being missing
+func (r *Repo) FileVersions(snaps []Snapshot, path string) ([]FileVersion, error) {
+	var versions []FileVersion
+	present := false
+	for i := range snaps {
+		node, found, err := r.findNode(&snaps[i], path)
+		if err != nil {
+			return nil, err
+		}
+		if !found || node.Type != NodeFile {
+			present = false
+			continue
+		}
+
+		if n := len(versions); present && versions[n-1].Node.Hash == node.Hash {
+			versions[n-1].Last = &snaps[i]
+			versions[n-1].Count++
+			continue
+		}
+		versions = append(versions, FileVersion{Node: node, First: &snaps[i], Last: &snaps[i], Count: 1})
+		present = true
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%v is not a file in any snapshot", path)
+	}
+	return versions, nil
+}
+
+//the time formats a snapshot can be picked by and how long a time in each lasts, see FindSnapshot
+var snapshotTimes = []struct {
+	layout string
+	span   time.Duration
+}{
+	{time.RFC3339, time.Second},
+	{"2006-01-02 15:04:05", time.Second},
+	{"2006-01-02 15:04", time.Minute},
+	{"2006-01-02", 24 * time.Hour},
+}
+
+//pick a snapshot out of snaps, which are sorted oldest first
+//spec is "latest", a snapshot id or a unique prefix of one,
+//or a local date or time, which picks the last snapshot taken by then, a date by the end of that day
+func FindSnapshot(snaps []Snapshot, spec string) (*Snapshot, error) {
+	if len(snaps) == 0 {
+		return nil, errors.New("there are no snapshots")
+	}
+	if spec == "latest" {
+		return &snaps[len(snaps)-1], nil
+	}
+
+	for _, t := range snapshotTimes {
+		at, err := time.ParseInLocation(t.layout, spec, time.Local)
+		if err != nil {
+			continue
+		}
+		at = at.Add(t.span)
+		for i := len(snaps) - 1; i >= 0; i-- {
+			if snaps[i].Time.Before(at) {
+				return &snaps[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no snapshot was taken by %v", spec)
+	}
+
+	var found *Snapshot
+	for i := range snaps {
+		if strings.HasPrefix(snaps[i].ID, spec) {
+			if found != nil {
+				return nil, fmt.Errorf("%v matches more than one snapshot", spec)
+			}
+			found = &snaps[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no snapshot %v", spec)
+	}
+	return found, nil
+}
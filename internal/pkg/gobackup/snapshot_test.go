@@ -0,0 +1,221 @@
+package gobackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//the Metadata of files in dir, named by their paths below it, without storing them
+func snapshotFiles(dir string, hashes map[string]string) []Metadata {
+	var files []Metadata
+	for name, hash := range hashes {
+		files = append(files, Metadata{FileName: Stream(filepath.Join(dir, name)), Hash: hash, Size: 10,
+			Atime: time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC), Permissions: "-rw-r--r--"})
+	}
+	return files
+}
+
+//the trees stored on b
+func storedTrees(b *memBackend) int {
+	n := 0
+	for k := range b.values {
+		if strings.HasPrefix(k, treePrefix) {
+			n++
+		}
+	}
+	return n
+}
+
+//a directory that did not change keeps its tree, only the trees from a changed file up to the root are stored again
+func TestSnapshotSharesTrees(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "a"), 0755)
+	os.MkdirAll(filepath.Join(dir, "b"), 0755)
+	b := newMemBackend()
+	r := NewRepo(b, 0)
+
+	first, err := r.SaveSnapshot(snapshotFiles(dir, map[string]string{"a/x": "hash x", "b/y": "hash y"}), []string{dir}, []string{"daily"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trees := storedTrees(b)
+	second, err := r.SaveSnapshot(snapshotFiles(dir, map[string]string{"a/x": "hash x", "b/y": "hash y2"}), []string{dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := func(snap *Snapshot) (Node, Node) {
+		t.Helper()
+		a, err := r.FindNode(snap, filepath.Join(dir, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		y, err := r.FindNode(snap, filepath.Join(dir, "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a, y
+	}
+	a1, b1 := nodes(first)
+	a2, b2 := nodes(second)
+	if a1.Tree != a2.Tree {
+		t.Fatalf("the unchanged directory has trees %v and %v", a1.Tree, a2.Tree)
+	}
+	if b1.Tree == b2.Tree || first.Tree == second.Tree {
+		t.Fatal("the changed directory kept its tree")
+	}
+	//b, each directory above it and the root
+	if added, want := storedTrees(b)-trees, len(strings.Split(strings.Trim(filepath.ToSlash(filepath.Join(dir, "b")), "/"), "/"))+1; added != want {
+		t.Fatalf("the second snapshot stored %v trees, want %v", added, want)
+	}
+
+	snaps, err := NewRepo(b, 0).Snapshots()
+	if err != nil || len(snaps) != 2 || snaps[0].ID != first.ID || snaps[1].ID != second.ID {
+		t.Fatalf("read back %v snapshots: %v", len(snaps), err)
+	}
+	if len(snaps[0].Tags) != 1 || snaps[0].Tags[0] != "daily" || snaps[0].Paths[0] != dir {
+		t.Fatalf("the first snapshot reads back as %+v", snaps[0])
+	}
+}
+
+//a tree whose data does not match the hash it is stored under is refused
+func TestLoadTreeHashMismatch(t *testing.T) {
+	dir := t.TempDir()
+	b := newMemBackend()
+	r := NewRepo(b, 0)
+	snap, err := r.SaveSnapshot(snapshotFiles(dir, map[string]string{"x": "hash x"}), []string{dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := json.Marshal(Tree{Type: treeType, Nodes: []Node{{Name: "planted", Type: NodeFile, Hash: "hash p"}}})
+	b.Put(treePrefix+snap.Tree, bytes.NewReader(other))
+	if _, err := NewRepo(b, 0).LoadTree(snap.Tree); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("a replaced tree returned %v", err)
+	}
+	if _, err := NewRepo(b, 0).LoadTree(chunkHash([]byte("missing"))); err == nil {
+		t.Fatal("a missing tree was loaded")
+	}
+}
+
+//nodes are found by absolute path, a path below a file or through a missing directory is not in the snapshot
+func TestFindNode(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "a"), 0755)
+	os.Chmod(filepath.Join(dir, "a"), 0755)
+	r := NewRepo(newMemBackend(), 0)
+	snap, err := r.SaveSnapshot(snapshotFiles(dir, map[string]string{"a/x": "hash x"}), []string{dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if root, err := r.FindNode(snap, "/"); err != nil || root.Type != NodeDir || root.Tree != snap.Tree {
+		t.Fatalf("/ is %+v: %v", root, err)
+	}
+	if a, err := r.FindNode(snap, filepath.Join(dir, "a")+"/"); err != nil || a.Type != NodeDir || a.Mode != "-rwxr-xr-x" {
+		t.Fatalf("the directory is %+v: %v", a, err)
+	}
+	if x, err := r.FindNode(snap, filepath.Join(dir, "a", "x")); err != nil || x.Type != NodeFile || x.Hash != "hash x" {
+		t.Fatalf("the file is %+v: %v", x, err)
+	}
+	for _, path := range []string{filepath.Join(dir, "missing"), filepath.Join(dir, "a", "x", "below")} {
+		if node, err := r.FindNode(snap, path); err == nil || !strings.Contains(err.Error(), "is not in snapshot") {
+			t.Fatalf("%v was found as %+v: %v", path, node, err)
+		}
+	}
+}
+
+//snapshots are picked by id prefix, by "latest" or by a local date or time, a date meaning the end of that day
+func TestFindSnapshot(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+10", 10*3600)
+	t.Cleanup(func() { time.Local = local })
+	at := func(s string) time.Time {
+		when, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return when.UTC()
+	}
+	snaps := []Snapshot{
+		{ID: "aa11", Time: at("2026-10-01 13:00:00")},
+		{ID: "aa22", Time: at("2026-10-01 23:30:00")},
+		{ID: "bb33", Time: at("2026-10-02 00:30:00")},
+	}
+
+	for _, c := range []struct {
+		spec string
+		want string //the id picked, blank for an error
+	}{
+		{"latest", "bb33"},
+		{"aa2", "aa22"},
+		{"bb33", "bb33"},
+		{"aa", ""},
+		{"cc", ""},
+		{"2026-10-01", "aa22"},
+		{"2026-10-02", "bb33"},
+		{"2026-09-30", ""},
+		{"2026-10-01 13:00", "aa11"},
+		{"2026-10-01 12:59", ""},
+		{"2026-10-01 23:29:59", "aa11"},
+		{"2026-10-02T00:00:00+10:00", "aa22"},
+	} {
+		snap, err := FindSnapshot(snaps, c.spec)
+		switch {
+		case c.want == "" && err == nil:
+			t.Errorf("%q picked %v", c.spec, snap.ID)
+		case c.want != "" && (err != nil || snap.ID != c.want):
+			t.Errorf("%q picked %+v, want %v: %v", c.spec, snap, c.want, err)
+		}
+	}
+	if _, err := FindSnapshot(nil, "latest"); err == nil {
+		t.Error("a snapshot was found in none")
+	}
+}
+
+//a file that goes missing and comes back starts a new version, even with the same content
+func TestFileVersions(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRepo(newMemBackend(), 0)
+	var snaps []Snapshot
+	for _, x := range []string{"hash 1", "hash 1", "", "hash 1", "hash 2"} {
+		hashes := map[string]string{"y": "hash y"}
+		if x != "" {
+			hashes["x"] = x
+		}
+		snap, err := r.SaveSnapshot(snapshotFiles(dir, hashes), []string{dir}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snaps = append(snaps, *snap)
+	}
+
+	versions, err := r.FileVersions(snaps, filepath.Join(dir, "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		hash        string
+		first, last int
+	}{{"hash 1", 0, 1}, {"hash 1", 3, 3}, {"hash 2", 4, 4}}
+	if len(versions) != len(want) {
+		t.Fatalf("found %v versions, want %v", len(versions), len(want))
+	}
+	for i, w := range want {
+		v := versions[i]
+		if v.Node.Hash != w.hash || v.First.ID != snaps[w.first].ID || v.Last.ID != snaps[w.last].ID || v.Count != w.last-w.first+1 {
+			t.Errorf("version %v is %v in %v snapshots, want %v in snapshots %v to %v", i, v.Node.Hash, v.Count, w.hash, w.first, w.last)
+		}
+	}
+
+	for _, path := range []string{filepath.Join(dir, "missing"), dir} {
+		if _, err := r.FileVersions(snaps, path); err == nil {
+			t.Errorf("%v has versions", path)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package gobackup
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//the first error a stage of Upload could not go on after, the workers only drain their channels once it is set
+type uploadErr struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *uploadErr) set(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *uploadErr) get() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+//back up files to every target that does not hold them yet, checking jobs files at a time and uploading jobs files at a time
+//a file is only read when it is uploaded, one whose size and modification time match the catalog or the journal is known without reading it
+//each file is written to the journal as soon as a target holds all of it
+//found holds every file and the targets holding it, in the order of files, a file that could not be read is left blank
+//uploaded holds the files sent this run with their hashes and the targets now holding them, in no particular order
+//an error reading the catalog or writing the journal stops the run
+func Upload(files []string, targets []Target, catalog *Catalog, journal *Journal, jobs int) (found []Metadata, uploaded []Metadata, err error) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	found = make([]Metadata, len(files))
+	failed := &uploadErr{}
+	uploaded = upload(targets, journal, scan(files, targets, catalog, journal, found, jobs, failed), jobs, failed)
+	if err := failed.get(); err != nil {
+		return nil, nil, err
+	}
+	if len(uploaded) == 0 {
+		return found, nil, nil
+	}
+
+	//upload the last packs, files in a pack that failed are not on that target after all
+	for _, t := range targets {
+		for _, hash := range t.Flush() {
+			for i := range uploaded {
+				if uploaded[i].Hash == hash {
+					uploaded[i].Targets = removeTarget(uploaded[i].Targets, t.Name)
+				}
+			}
+		}
+	}
+	if err := journal.Commit(targets); err != nil {
+		return nil, nil, fmt.Errorf("writing the journal: %v", err)
+	}
+	return found, uploaded, nil
+}
+
+//check files on jobs workers and send the ones a target is missing down the returned channel
+//files the journal shows an interrupted run stored are sent too, so they reach the catalog
+//the hash of a changed file is left blank for upload to fill in
+//the channel is closed once every file was checked
+func scan(files []string, targets []Target, catalog *Catalog, journal *Journal, found []Metadata, jobs int, failed *uploadErr) <-chan Metadata {
+	indexes := make(chan int)
+	out := make(chan Metadata, jobs)
+
+	go func() {
+		for i := range files {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if failed.get() != nil {
+					continue
+				}
+				f := files[i]
+				meta, err := FileMeta(f)
+				if err != nil {
+					fmt.Println("SKIPPING! " + err.Error())
+					continue
+				}
+				entry, cataloged, err := catalog.Unchanged(f, meta.Size, meta.Atime)
+				if err != nil {
+					failed.set(fmt.Errorf("reading the catalog: %v", err))
+					continue
+				}
+				if cataloged {
+					meta.Hash, meta.Chunks, meta.Codec, meta.Targets = entry.Hash, entry.Chunks, entry.Codec, entry.Targets
+				}
+
+				resumed := journal.Resume(&meta)
+				found[i] = meta
+
+				//if not found, or a target is missing it
+				missing := missingTargets(targets, meta.Targets)
+				if cataloged && len(missing) == 0 && len(resumed) == 0 {
+					fmt.Println("FOUND AND EXCLUDING! " + meta.Hash)
+					continue
+				}
+				if len(resumed) > 0 {
+					fmt.Println("ALREADY ON " + strings.Join(resumed, ",") + " FROM AN INTERRUPTED RUN! " + meta.Hash)
+				}
+				if cataloged {
+					fmt.Println("MISSING FROM " + strings.Join(missing, ",") + " AND INCLUDING! " + meta.Hash + "-" + GetMetadata(meta))
+				} else {
+					fmt.Println("NEW OR CHANGED AND INCLUDING! " + GetMetadata(meta))
+				}
+				out <- meta
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+//upload the files coming down metas to every target that does not hold them yet on jobs workers
+//returns every file with the targets now holding it once metas is closed
+func upload(targets []Target, journal *Journal, metas <-chan Metadata, jobs int, failed *uploadErr) []Metadata {
+	results := make(chan Metadata)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for meta := range metas {
+				if failed.get() != nil {
+					continue
+				}
+				for _, err := range Replicate(targets, &meta) {
+					fmt.Println("UPLOAD FAILED! " + err.Error())
+				}
+				journal.Add(meta)
+				if err := journal.Commit(targets); err != nil {
+					failed.set(fmt.Errorf("writing the journal: %v", err))
+					continue
+				}
+				results <- meta
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	//only this goroutine touches list
+	var list []Metadata
+	for meta := range results {
+		list = append(list, meta)
+	}
+	return list
+}
+
+//the targets that are not listed in stored
+func missingTargets(targets []Target, stored []string) []string {
+	var missing []string
+	for _, t := range targets {
+		if !HasTarget(Metadata{Targets: stored}, t.Name) {
+			missing = append(missing, t.Name)
+		}
+	}
+	return missing
+}
+
+//remove name from targets
+func removeTarget(targets []string, name string) []string {
+	var kept []string
+	for _, t := range targets {
+		if t != name {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
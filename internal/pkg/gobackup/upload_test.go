@@ -0,0 +1,115 @@
+package gobackup
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+//files are checked and uploaded on several workers, run it with -race
+//every file reaches every target once and is journaled, a second run finds them all in the catalog
+func TestUpload(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 24; i++ {
+		size := 1000 * (i + 1)
+		if i%6 == 0 {
+			size = 2 * MinChunkSize
+		}
+		files = append(files, writeRandomFile(t, dir, fmt.Sprintf("file%02d", i), int64(i), size))
+	}
+	//the same content under a second path
+	files = append(files, writeRandomFile(t, dir, "copy", 1, 2000))
+	sort.Strings(files)
+
+	targets := []Target{{Name: "packed", Repo: NewRepo(newMemBackend(), 1<<20)}, {Name: "single", Repo: NewRepo(newMemBackend(), 0)}}
+	catalog := openTestCatalog(t, filepath.Join(dir, DefaultCatalogFile))
+	journalFile := JournalFile(filepath.Join(dir, DefaultCatalogFile))
+	journal, err := OpenJournal(journalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, uploaded, err := Upload(files, targets, catalog, journal, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(files) || len(uploaded) != len(files) {
+		t.Fatalf("found %v and uploaded %v of %v files", len(found), len(uploaded), len(files))
+	}
+	for i, meta := range found {
+		if string(meta.FileName) != files[i] {
+			t.Fatalf("file %v was found as %v", files[i], meta.FileName)
+		}
+	}
+	seen := map[string]bool{}
+	for _, meta := range uploaded {
+		name := string(meta.FileName)
+		if seen[name] || meta.Hash != Md5file(name) || strings.Join(meta.Targets, ",") != "packed,single" {
+			t.Fatalf("%v was uploaded as %v to %v", name, meta.Hash, meta.Targets)
+		}
+		seen[name] = true
+		for _, target := range targets {
+			checkRestore(t, NewRepo(target.Backend, 0), meta.Hash, name)
+		}
+	}
+
+	//a run cut short here would skip every file
+	again, err := OpenJournal(journalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, meta := range found {
+		meta.Targets = nil
+		if resumed := again.Resume(&meta); len(resumed) != 2 {
+			t.Fatalf("the journal holds %v on %v", meta.FileName, resumed)
+		}
+	}
+	again.Remove()
+
+	if err := catalog.Add(uploaded); err != nil {
+		t.Fatal(err)
+	}
+	journal, err = OpenJournal(journalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, uploaded, err = Upload(files, targets, catalog, journal, 4)
+	if err != nil || len(uploaded) != 0 {
+		t.Fatalf("the second run uploaded %v files: %v", len(uploaded), err)
+	}
+	for i, meta := range found {
+		if meta.Hash != Md5file(files[i]) || len(meta.Targets) != 2 {
+			t.Fatalf("the second run found %v as %v on %v", files[i], meta.Hash, meta.Targets)
+		}
+	}
+	journal.Remove()
+}
+
+//a target refusing uploads is left out of the files, the others get them
+func TestUploadFailedTarget(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 8; i++ {
+		files = append(files, writeRandomFile(t, dir, fmt.Sprintf("file%v", i), int64(i), 1000*(i+1)))
+	}
+	targets := []Target{{Name: "bad", Repo: NewRepo(failBackend{newMemBackend()}, 1<<20)}, {Name: "good", Repo: NewRepo(newMemBackend(), 1<<20)}}
+	catalog := openTestCatalog(t, filepath.Join(dir, DefaultCatalogFile))
+	journal, err := OpenJournal(JournalFile(filepath.Join(dir, DefaultCatalogFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Remove()
+
+	_, uploaded, err := Upload(files, targets, catalog, journal, 3)
+	if err != nil || len(uploaded) != len(files) {
+		t.Fatalf("uploaded %v of %v files: %v", len(uploaded), len(files), err)
+	}
+	for _, meta := range uploaded {
+		if strings.Join(meta.Targets, ",") != "good" {
+			t.Fatalf("%v is on %v", meta.FileName, meta.Targets)
+		}
+	}
+}
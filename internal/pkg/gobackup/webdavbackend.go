@@ -0,0 +1,310 @@
+package gobackup
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//WebDAV stores objects on a WebDAV share such as Nextcloud or ownCloud
+//the layout matches the dir backend, URL/<first two characters of key>/<key>
+type WebDAV struct {
+	base     *url.URL
+	user     string
+	password string
+	client   *httpClient
+
+	mu   sync.Mutex
+	made map[string]bool //collections known to exist
+}
+
+//create a WebDAV backend from the [webdav] preferences
+func NewWebDAV(cf *Account) (*WebDAV, error) {
+	conf := cf.WebDAV
+	if conf.URL == "" {
+		return nil, fmt.Errorf("the webdav backend needs a url")
+	}
+	base, err := url.Parse(strings.TrimSuffix(conf.URL, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WebDAV{base: base, user: conf.User, password: conf.Password, client: newHTTPClient(nil), made: map[string]bool{}}
+
+	//make sure the backup folder exists
+	if err := w.mkcol(""); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+//the path of key relative to the share
+func (w *WebDAV) path(key string) (string, error) {
+	if len(key) < 2 || strings.HasPrefix(key, "/") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return key[:2] + "/" + key, nil
+}
+
+//build an authenticated request for name, a slash separated path relative to the share
+func (w *WebDAV) newRequest(method string, name string, body io.Reader) (*http.Request, error) {
+	u := *w.base
+	u.Path = w.base.Path + name
+	u.RawPath = ""
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if w.user != "" {
+		req.SetBasicAuth(w.user, w.password)
+	}
+	return req, nil
+}
+
+//send the request and turn a non 2xx status into an error
+//rate limited and failed requests are retried, see httpClient
+//the caller must close the body of the returned response
+func (w *WebDAV) do(req *http.Request) (*http.Response, error) {
+	return w.client.do(req)
+}
+
+//create the collection dir and any missing parents
+//a 405 means the collection already exists
+func (w *WebDAV) mkcol(dir string) error {
+	parts := strings.Split(strings.Trim(dir, "/"), "/")
+	current := ""
+	for _, part := range parts {
+		if part != "" {
+			current += part + "/"
+		}
+
+		w.mu.Lock()
+		made := w.made[current]
+		w.mu.Unlock()
+		if made {
+			continue
+		}
+
+		req, err := w.newRequest("MKCOL", current, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := w.client.send(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed &&
+			(resp.StatusCode < 200 || resp.StatusCode > 299) {
+			return fmt.Errorf("MKCOL %v: %v", req.URL.Path, resp.Status)
+		}
+
+		w.mu.Lock()
+		w.made[current] = true
+		w.mu.Unlock()
+	}
+	return nil
+}
+
+//upload the value read from r
+func (w *WebDAV) Put(key string, r io.Reader) error {
+	name, err := w.path(key)
+	if err != nil {
+		return err
+	}
+	if err := w.mkcol(path.Dir(name)); err != nil {
+		return err
+	}
+
+	req, err := w.newRequest(http.MethodPut, name, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := w.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//download the value of key into wr
+func (w *WebDAV) Get(key string, wr io.Writer) error {
+	name, err := w.path(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := w.newRequest(http.MethodGet, name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(wr, resp.Body)
+	return err
+}
+
+//one entry of a PROPFIND multistatus response
+type davResponse struct {
+	Href     string `xml:"href"`
+	Propstat []struct {
+		Prop struct {
+			ResourceType struct {
+				Collection *struct{} `xml:"collection"`
+			} `xml:"resourcetype"`
+			ContentLength string `xml:"getcontentlength"`
+		} `xml:"prop"`
+		Status string `xml:"status"`
+	} `xml:"propstat"`
+}
+
+//is the entry a collection
+func (d davResponse) isDir() bool {
+	for _, ps := range d.Propstat {
+		if ps.Prop.ResourceType.Collection != nil {
+			return true
+		}
+	}
+	return false
+}
+
+//the size reported for the entry, -1 if the server left it out
+func (d davResponse) size() int64 {
+	for _, ps := range d.Propstat {
+		if n, err := strconv.ParseInt(ps.Prop.ContentLength, 10, 64); err == nil {
+			return n
+		}
+	}
+	return -1
+}
+
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/></d:prop></d:propfind>`
+
+//run PROPFIND on name with the given depth
+//the returned hrefs are made relative to the share
+func (w *WebDAV) propfind(name string, depth string) ([]davResponse, error) {
+	req, err := w.newRequest("PROPFIND", name, strings.NewReader(davPropfind))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := w.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms struct {
+		Responses []davResponse `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+
+	for i := range ms.Responses {
+		href, err := url.Parse(ms.Responses[i].Href)
+		if err != nil {
+			return nil, err
+		}
+		ms.Responses[i].Href = strings.TrimPrefix(href.Path, w.base.Path)
+	}
+	return ms.Responses, nil
+}
+
+//walk the collections with depth 1 PROPFIND requests and return every key starting with prefix
+//Nextcloud and many other servers refuse depth infinity, so the tree is walked one level at a time
+func (w *WebDAV) List(prefix string) ([]string, error) {
+	var keys []string
+	pending := []string{""}
+
+	for len(pending) > 0 {
+		dir := pending[0]
+		pending = pending[1:]
+
+		entries, err := w.propfind(dir, "1")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			name := strings.TrimSuffix(entry.Href, "/")
+			if name == strings.TrimSuffix(dir, "/") {
+				continue //the collection itself
+			}
+
+			if entry.isDir() {
+				pending = append(pending, name+"/")
+				continue
+			}
+
+			//drop the two character fan out directory
+			parts := strings.SplitN(name, "/", 2)
+			if len(parts) == 2 && strings.HasPrefix(parts[1], prefix) {
+				keys = append(keys, parts[1])
+			}
+		}
+	}
+	return keys, nil
+}
+
+//remove key from the share
+func (w *WebDAV) Delete(key string) error {
+	name, err := w.path(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := w.newRequest(http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.do(req)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//get the size of key with a depth 0 PROPFIND
+func (w *WebDAV) Stat(key string) (ObjectInfo, error) {
+	name, err := w.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	entries, err := w.propfind(name, "0")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if len(entries) == 0 || entries[0].isDir() {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return ObjectInfo{Key: key, Size: entries[0].size()}, nil
+}
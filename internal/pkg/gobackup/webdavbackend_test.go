@@ -0,0 +1,72 @@
+package gobackup
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+//a WebDAV share below a Nextcloud style path, with basic authentication
+//depth infinity PROPFIND is refused like Nextcloud does
+func newWebDAVServer(t *testing.T) (*Account, *atomic.Int64) {
+	dav := &webdav.Handler{Prefix: "/remote.php/dav/files/user", FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}
+	requests := &atomic.Int64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if user, password, ok := req.BasicAuth(); !ok || user != "user" || password != "app password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.Method == "PROPFIND" && req.Header.Get("Depth") != "0" && req.Header.Get("Depth") != "1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		dav.ServeHTTP(w, req)
+	}))
+	t.Cleanup(server.Close)
+	return &Account{WebDAV: WebDAVAccount{URL: server.URL + "/remote.php/dav/files/user/goBackup", User: "user", Password: "app password"}}, requests
+}
+
+func TestWebDAVBackend(t *testing.T) {
+	cf, _ := newWebDAVServer(t)
+	w, err := NewWebDAV(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, w)
+}
+
+//collections are made once, and a repo reads back what it saved
+func TestWebDAVRepo(t *testing.T) {
+	cf, requests := newWebDAVServer(t)
+	w, err := NewWebDAV(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	r := NewRepo(w, 0)
+	name := writeRandomFile(t, dir, "file", 1, 3*MinChunkSize)
+	key, chunks, _, err := r.SaveFile("", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRestore(t, NewRepo(w, 0), key, name)
+
+	//a chunk already stored costs one request to find, a new one its PUT and the MKCOL of its new collection at most
+	before := requests.Load()
+	if _, _, _, err := r.SaveFile("", name); err != nil {
+		t.Fatal(err)
+	}
+	if spent := requests.Load() - before; spent > int64(len(chunks)+2) {
+		t.Fatalf("saving a stored file again took %v requests for %v chunks", spent, len(chunks))
+	}
+
+	cf.WebDAV.Password = "wrong"
+	if _, err := NewWebDAV(cf); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("a wrong password returned %v", err)
+	}
+}
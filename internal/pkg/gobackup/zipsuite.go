@@ -1,113 +1,447 @@
 package gobackup
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"compress/gzip"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 // creates a zip file named zipname using filename as the source file
-func ZipFile(filename string, zipname string) {
-	fmt.Println("zipfile")
-
+func ZipFile(filename string, zipname string) error {
 	//open the file to be zipped
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
-
 	defer file.Close()
 
 	//get the fileInfo => will be transferred to zip
-	fileInfo, _ := file.Stat()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
 
 	//create the zip file
 	zipFile, err := os.Create(zipname)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
 	defer zipFile.Close()
 
 	//create a zip writer
 	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
 
 	//create a zip file header
-	fh, error := zip.FileInfoHeader(fileInfo)
-	if error != nil {
-		fmt.Println("File Info error")
+	fh, err := zip.FileInfoHeader(fileInfo)
+	if err != nil {
+		return err
 	}
 
-	//alter the name of the file, can use full path
-	workingDir, _ := os.Getwd()
-	fullPath := workingDir + filename
-	fh.Name = fullPath
+	//store the path relative to the working directory
+	fh.Name = archiveName(filename)
 
 	//specify the method of zipping
 	fh.Method = zip.Deflate
 
 	//create the new zip header
-	writer, _ := zipWriter.CreateHeader(fh)
+	writer, err := zipWriter.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
 
 	//copy from file to the writer
-	_, err = io.Copy(writer, file)
+	if _, err = io.Copy(writer, file); err != nil {
+		return err
+	}
+	if err := zipWriter.Close(); err != nil {
+		return err
+	}
+	return zipFile.Close()
+}
+
+//the formats an archive can be written in
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+//the archive format named by the extension of filename, .zip, .tar.gz or .tgz
+func ArchiveFormat(filename string) (string, error) {
+	lower := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return ArchiveZip, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return ArchiveTarGz, nil
+	}
+	return "", fmt.Errorf("%v: archives end in .zip, .tar.gz or .tgz", filename)
+}
+
+//the name a file is stored under in an archive
+//the path keeps its directories, with the volume, leading slashes and leading .. removed like tar does
+func archiveName(name string) string {
+	name = filepath.ToSlash(filepath.Clean(strings.TrimPrefix(name, filepath.VolumeName(name))))
+	for {
+		switch {
+		case strings.HasPrefix(name, "/"):
+			name = name[1:]
+		case strings.HasPrefix(name, "../"):
+			name = name[3:]
+		case name == "..", name == "":
+			return "."
+		default:
+			return name
+		}
+	}
+}
+
+//an archive being written, one entry at a time
+type archiveWriter interface {
+	//add the entry name described by info, link is the target of a symlink and r the contents of a regular file
+	add(name string, info os.FileInfo, link string, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (z *zipArchive) add(name string, info os.FileInfo, link string, r io.Reader) error {
+	fh, err := zip.FileInfoHeader(info)
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+	fh.Name = name
+	if info.IsDir() {
+		fh.Name += "/"
+	} else {
+		fh.Method = zip.Deflate
 	}
 
+	writer, err := z.w.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		//zip keeps the target of a symlink as its contents
+		_, err = io.WriteString(writer, link)
+	case info.Mode().IsRegular():
+		_, err = io.Copy(writer, r)
+	}
+	return err
 }
 
-// zips a file named filename to the provided pipes pr and pw
-func ZipPipe(pr *io.PipeReader, pw *io.PipeWriter, filename string) {
+func (z *zipArchive) Close() error {
+	return z.w.Close()
+}
 
-	//open the file to be zipped
-	file, err := os.Open(filename)
+type tarArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (t *tarArchive) add(name string, info os.FileInfo, link string, r io.Reader) error {
+	hdr, err := tar.FileInfoHeader(info, link)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
-	defer file.Close()
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		_, err = io.Copy(t.tw, r)
+	}
+	return err
+}
 
-	//get the fileInfo => will be transferred to zip
-	fileInfo, err := file.Stat()
+func (t *tarArchive) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+//stream every file, directory and symlink under locations into w as a single archive in format
+//entries keep their permissions and modification times under their paths from archiveName
+//returns the number of entries written
+func WriteArchive(w io.Writer, format string, locations []string) (int, error) {
+	var archive archiveWriter
+	switch format {
+	case ArchiveZip:
+		archive = &zipArchive{w: zip.NewWriter(w)}
+	case ArchiveTarGz:
+		gz := gzip.NewWriter(w)
+		archive = &tarArchive{gz: gz, tw: tar.NewWriter(gz)}
+	default:
+		return 0, fmt.Errorf("unknown archive format %q", format)
+	}
+
+	count := 0
+	seen := map[string]bool{}
+	for _, location := range locations {
+		location = strings.TrimSpace(location)
+		if location == "" {
+			continue
+		}
+
+		//Walk does not follow symlinks, they are stored as links
+		err := filepath.Walk(location, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			name := archiveName(path)
+			if name == "." || seen[name] {
+				return nil
+			}
+			seen[name] = true
+
+			var link string
+			var file *os.File
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			case info.Mode().IsRegular():
+				if file, err = os.Open(path); err != nil {
+					return err
+				}
+				defer file.Close()
+			case !info.IsDir():
+				//devices, sockets and pipes are not backed up
+				return nil
+			}
+
+			if err := archive.add(name, info, link, file); err != nil {
+				return fmt.Errorf("%v: %v", path, err)
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			archive.Close()
+			return count, err
+		}
+	}
+	return count, archive.Close()
+}
+
+//write every file under locations into a new archive called filename, the format follows its extension
+func ExportArchive(filename string, locations []string) (int, error) {
+	format, err := ArchiveFormat(filename)
 	if err != nil {
-		log.Println(err)
+		return 0, err
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return 0, err
 	}
 
-	//create a zip writer
-	zipWriter := zip.NewWriter(pw)
-	defer zipWriter.Close()
+	count, err := WriteArchive(file, format, locations)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return count, err
+}
 
-	//create a zip file header
-	fh, error := zip.FileInfoHeader(fileInfo)
-	if error != nil {
-		fmt.Println("File Info error")
+//the path an archive entry is extracted to under dest
+//entries that would land outside dest are refused
+func extractPath(dest string, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("entry is outside the destination")
 	}
+	return filepath.Join(dest, clean), nil
+}
 
-	//alter the name of the file, can use full path
-	workingDir, _ := os.Getwd()
-	workingDir = workingDir[3:]
+//an archive being extracted
+//directory permissions and symlinks are only applied at the end, so a read only directory or a link cannot redirect later entries
+type extraction struct {
+	dest  string
+	dirs  map[string]os.FileMode
+	times map[string]time.Time
+	links [][2]string
+	count int
+}
 
-	fullPath := workingDir + string(os.PathSeparator) + filename
-	fmt.Println("THE FULL PATH:" + fullPath)
-	fh.Name = fullPath
+func (x *extraction) dir(name string, mode os.FileMode, modified time.Time) error {
+	path, err := extractPath(x.dest, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+	x.dirs[path] = mode.Perm()
+	x.times[path] = modified
+	x.count++
+	return nil
+}
 
-	//specify the method of zipping
-	fh.Method = zip.Deflate
+func (x *extraction) file(name string, mode os.FileMode, modified time.Time, r io.Reader) error {
+	path, err := extractPath(x.dest, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
 
-	//create the new zip header
-	writer, _ := zipWriter.CreateHeader(fh)
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(path, mode.Perm())
+	}
+	if err == nil {
+		err = os.Chtimes(path, modified, modified)
+	}
+	x.count++
+	return err
+}
+
+func (x *extraction) link(name string, target string) error {
+	path, err := extractPath(x.dest, name)
+	if err != nil {
+		return err
+	}
+	x.links = append(x.links, [2]string{path, target})
+	x.count++
+	return nil
+}
+
+//create the symlinks and apply the directory permissions, deepest directories first
+func (x *extraction) finish() error {
+	for _, l := range x.links {
+		if err := os.MkdirAll(filepath.Dir(l[0]), 0700); err != nil {
+			return err
+		}
+		os.Remove(l[0])
+		if err := os.Symlink(l[1], l[0]); err != nil {
+			return err
+		}
+	}
+
+	dirs := make([]string, 0, len(x.dirs))
+	for d := range x.dirs {
+		dirs = append(dirs, d)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		os.Chtimes(d, x.times[d], x.times[d])
+		if err := os.Chmod(d, x.dirs[d]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//extract the archive called filename, written by ExportArchive, into dest
+//returns the number of entries extracted
+func ImportArchive(filename string, dest string) (int, error) {
+	format, err := ArchiveFormat(filename)
+	if err != nil {
+		return 0, err
+	}
+	x := &extraction{dest: dest, dirs: map[string]os.FileMode{}, times: map[string]time.Time{}}
+
+	switch format {
+	case ArchiveZip:
+		err = x.zip(filename)
+	case ArchiveTarGz:
+		err = x.tar(filename)
+	}
+	if err == nil {
+		err = x.finish()
+	}
+	return x.count, err
+}
 
-	//move data into the pipe
-	_, _ = io.Copy(writer, file)
+func (x *extraction) zip(filename string) error {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		mode := f.Mode()
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%v: %v", f.Name, err)
+		}
+
+		switch {
+		case mode.IsDir():
+			err = x.dir(f.Name, mode, f.Modified)
+		case mode&os.ModeSymlink != 0:
+			var target []byte
+			if target, err = ioutil.ReadAll(rc); err == nil {
+				err = x.link(f.Name, string(target))
+			}
+		case mode.IsRegular():
+			err = x.file(f.Name, mode, f.Modified, rc)
+		}
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %v", f.Name, err)
+		}
+	}
+	return nil
+}
 
-	//flush and close the writer
-	zipWriter.Close()
+func (x *extraction) tar(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-	//close data pipe, signalling the end
-	pw.Close()
-	//	fmt.Printf("Wrote %v\n", n)
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.dir(hdr.Name, mode, hdr.ModTime)
+		case tar.TypeSymlink:
+			err = x.link(hdr.Name, hdr.Linkname)
+		case tar.TypeReg:
+			err = x.file(hdr.Name, mode, hdr.ModTime, tr)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", hdr.Name, err)
+		}
+	}
 }
 
 /*
@@ -0,0 +1,55 @@
+package gobackup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//a missing file is an error, not a crash
+func TestZipFileMissing(t *testing.T) {
+	dir := t.TempDir()
+	if err := ZipFile(filepath.Join(dir, "missing.txt"), filepath.Join(dir, "out.zip")); err == nil {
+		t.Fatal("zipping a missing file succeeded")
+	}
+}
+
+//every file exported to an archive comes back with its content and permissions
+func TestArchiveRoundTrip(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll(filepath.Join("src", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		filepath.Join("src", "a.txt"):        []byte("hello"),
+		filepath.Join("src", "sub", "b.bin"): {0, 1, 2, 255},
+	}
+	for name, data := range files {
+		if err := os.WriteFile(name, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, archive := range []string{"out.zip", "out.tar.gz"} {
+		if _, err := ExportArchive(archive, []string{"src"}); err != nil {
+			t.Fatalf("%v: %v", archive, err)
+		}
+		dest := filepath.Join("dest", archive)
+		if _, err := ImportArchive(archive, dest); err != nil {
+			t.Fatalf("%v: %v", archive, err)
+		}
+		for name, want := range files {
+			got, err := os.ReadFile(filepath.Join(dest, name))
+			if err != nil {
+				t.Fatalf("%v: %v", archive, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%v: %v holds %q, want %q", archive, name, got, want)
+			}
+			if fi, err := os.Stat(filepath.Join(dest, name)); err == nil && fi.Mode().Perm() != 0640 {
+				t.Errorf("%v: %v has mode %v, want 0640", archive, name, fi.Mode().Perm())
+			}
+		}
+	}
+}